@@ -0,0 +1,186 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/lego"
+
+	"github.com/letsencrypt/test-certs-site/certs"
+	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/scheduler"
+	"github.com/letsencrypt/test-certs-site/storage"
+)
+
+// account is the ACME account for one directory, shared by the issuers of all sites using it,
+// and the clients using it. The clients are replaced whenever the account key is rolled over.
+type account struct {
+	cfg      config.ACME
+	manager  *certs.CertManager
+	schedule *scheduler.Schedule
+	store    storage.Storage
+
+	// profiles maps the names of the CA's profiles to their descriptions, from its directory
+	profiles map[string]string
+
+	// mu protects the fields below
+	mu sync.Mutex
+
+	// user holds the account URI and current key
+	user *legoUser
+
+	// keyCreated is when the user's key was generated. Zero if unknown.
+	keyCreated time.Time
+
+	// clients is a map of a site's valid domain to that site's client
+	clients map[string]*lego.Client
+}
+
+// newAccount loads or registers the account for a directory.
+func newAccount(
+	ctx context.Context,
+	acmeCfg config.ACME,
+	store storage.Storage,
+	schedule *scheduler.Schedule,
+	manager *certs.CertManager,
+) (*account, error) {
+	user, keyCreated, err := setupLego(ctx, acmeCfg, store)
+	if err != nil {
+		return nil, err
+	}
+
+	acct := &account{
+		cfg:        acmeCfg,
+		manager:    manager,
+		schedule:   schedule,
+		store:      store,
+		user:       user,
+		keyCreated: keyCreated,
+		clients:    make(map[string]*lego.Client),
+	}
+
+	core, err := acct.core()
+	if err != nil {
+		return nil, fmt.Errorf("fetching directory: %w", err)
+	}
+
+	acct.profiles = core.GetDirectory().Meta.Profiles
+
+	return acct, nil
+}
+
+// profile returns the description of one of the CA's profiles, or an error if the CA doesn't offer it.
+func (a *account) profile(name string) (string, error) {
+	description, ok := a.profiles[name]
+	if ok {
+		return description, nil
+	}
+
+	if len(a.profiles) == 0 {
+		return "", fmt.Errorf("profile %q isn't offered by %s, which has no profiles", name, a.cfg.Directory)
+	}
+
+	offered := slices.Sorted(maps.Keys(a.profiles))
+
+	return "", fmt.Errorf("profile %q isn't offered by %s, which offers: %s", name, a.cfg.Directory, strings.Join(offered, ", "))
+}
+
+// client returns the client for a site, creating it if needed.
+func (a *account) client(site config.Site) (*lego.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	client, ok := a.clients[site.Domains.Valid]
+	if ok {
+		return client, nil
+	}
+
+	client, err := newSiteClient(a.user, a.cfg.Directory, site, a.manager)
+	if err != nil {
+		return nil, err
+	}
+
+	a.clients[site.Domains.Valid] = client
+
+	return client, nil
+}
+
+// core returns a client for the ACME API, for requests lego's client doesn't support.
+func (a *account) core() (*api.Core, error) {
+	a.mu.Lock()
+	user := a.user
+	a.mu.Unlock()
+
+	legoCfg := newConfig(user, a.cfg.Directory)
+
+	return api.New(legoCfg.HTTPClient, legoCfg.UserAgent, a.cfg.Directory, user.reg.URI, user.key)
+}
+
+// rolloverAt returns when the account key reaches its maximum age.
+// Returns a zero time if no maximum age is configured.
+func (a *account) rolloverAt() time.Time {
+	maxAge := time.Duration(a.cfg.MaxAccountKeyAge)
+	if maxAge == 0 {
+		return time.Time{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.keyCreated.Add(maxAge)
+}
+
+// rotate is a scheduled job which rolls over the account key once it is due, then reschedules itself.
+func (a *account) rotate(ctx context.Context) {
+	at := a.rolloverAt()
+	if at.IsZero() {
+		return
+	}
+
+	if time.Now().Before(at) {
+		slog.Info("scheduling account key rollover", slog.String("directory", a.cfg.Directory), slog.Time("at", at))
+		a.schedule.RunAt(at, a.rotate)
+
+		return
+	}
+
+	err := a.rollover(ctx)
+	if err != nil {
+		slog.Error("rolling over account key; will retry", slog.String("directory", a.cfg.Directory), slogErr(err))
+		a.schedule.RunIn(time.Hour, a.rotate)
+
+		return
+	}
+
+	a.schedule.RunAt(a.rolloverAt(), a.rotate)
+}
+
+// rollover replaces the account key, and the clients using the old one.
+// Only the rotate job calls it, so rollovers don't overlap. The lock isn't held while talking to the CA,
+// so issuers aren't held up waiting for it.
+func (a *account) rollover(ctx context.Context) error {
+	acct, err := rolloverKey(ctx, a.cfg.Directory, a.store)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.user = &legoUser{
+		reg:   a.user.reg,
+		key:   acct.Key,
+		email: a.user.email,
+	}
+	a.keyCreated = acct.KeyCreated
+	clear(a.clients)
+
+	return nil
+}
@@ -2,35 +2,47 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"log/slog"
 	mathrand "math/rand/v2"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	legoAcme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/log"
 	"github.com/go-acme/lego/v4/registration"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/letsencrypt/test-certs-site/certs"
 	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/rfc2136"
 	"github.com/letsencrypt/test-certs-site/scheduler"
 	"github.com/letsencrypt/test-certs-site/storage"
 )
 
 // legoUser implements lego's registration.User interface.
 type legoUser struct {
-	reg *registration.Resource
-	key *ecdsa.PrivateKey
+	reg   *registration.Resource
+	key   *ecdsa.PrivateKey
+	email string
 }
 
 func (u *legoUser) GetEmail() string {
-	return ""
+	return u.email
 }
 
 func (u *legoUser) GetRegistration() *registration.Resource {
@@ -41,117 +53,297 @@ func (u *legoUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-func setupLego(cfg *config.Config, store *storage.Storage, user legoUser) (*lego.Client, error) {
+// setupLego loads or registers the ACME account for a directory, returning the user for creating clients
+// and when its key was created.
+func setupLego(ctx context.Context, acmeCfg config.ACME, store storage.Storage) (*legoUser, time.Time, error) {
 	// Lego users can configure a custom logger by setting it in this global.
 	log.Logger = slog.NewLogLogger(slog.Default().Handler(), slog.LevelInfo)
 
+	var user legoUser
+
 	// Try to load an existing ACME account
-	accountURI, acctKey, err := store.ReadACME(cfg.ACME.Directory)
+	acct, err := store.ReadACME(acmeCfg.Directory)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// Registering would replace the stored account, which may still be in use, or partway through a rollover
+		return nil, time.Time{}, fmt.Errorf("reading ACME account: %w", err)
+	}
+	if err == nil && acct.PreviousKey != nil {
+		// We stopped partway through a key rollover, so finish it before using the account
+		acct, err = resumeRollover(ctx, acmeCfg.Directory, acct, store)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	keyCreated := acct.KeyCreated
+
 	if err != nil {
 		// No account, need to make a new key
 		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
-			return nil, err
+			return nil, time.Time{}, err
 		}
 		user.key = key
+		keyCreated = time.Now()
 	} else {
 		user = legoUser{
 			reg: &registration.Resource{
-				URI: accountURI,
+				URI: acct.URI,
 			},
-			key: acctKey,
+			key: acct.Key,
+		}
+		slog.Info("Loaded ACME account", slog.String("directory", acmeCfg.Directory), slog.String("User", user.reg.URI),
+			slog.String("eabKeyID", acct.EABKeyID))
+
+		if acct.EABKeyID != acmeCfg.EABKeyID {
+			// Accounts can't be re-bound, so keep using it. Delete the stored account to register a new one.
+			slog.Warn("ACME account was registered with a different EAB key ID than configured",
+				slog.String("directory", acmeCfg.Directory),
+				slog.String("storedKeyID", acct.EABKeyID),
+				slog.String("configuredKeyID", acmeCfg.EABKeyID))
 		}
-		slog.Info("Loaded ACME account", slog.String("directory", cfg.ACME.Directory), slog.String("User", user.reg.URI))
 	}
 
-	client, err := newClient(&user, cfg.ACME.Directory)
+	client, err := newClient(&user, acmeCfg.Directory)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
-	if user.reg != nil && !checkRegistration(&user, client, cfg) {
-		// We have an account, but the CA doesn't know about it. Reset user and client and re-register
-		user.reg = nil
-		client, err = newClient(&user, cfg.ACME.Directory)
-		if err != nil {
-			return nil, err
+	// lego only registers a single email contact. Any others are added by updateContacts.
+	user.email = firstEmail(acmeCfg.Contacts)
+
+	if user.reg != nil {
+		reg := checkRegistration(&user, client, acmeCfg.Directory)
+		if reg == nil {
+			// We have an account, but the CA doesn't know about it. Reset user and client and re-register
+			user.reg = nil
+			client, err = newClient(&user, acmeCfg.Directory)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+		} else {
+			user.reg.Body = reg.Body
 		}
 	}
 
 	if user.reg == nil {
-		err = register(&user, client, cfg, store)
+		err = register(&user, client, acmeCfg, store, keyCreated)
 		if err != nil {
-			return nil, err
+			return nil, time.Time{}, err
 		}
 	}
 
-	return client, nil
+	err = updateContacts(&user, acmeCfg)
+	if err != nil {
+		// Certificates can still be issued with the old contacts, so don't stop for the CA being unavailable
+		slog.Warn("Couldn't update ACME account contacts; will retry at next startup",
+			slog.String("directory", acmeCfg.Directory),
+			slogErr(err))
+	}
+
+	return &user, keyCreated, nil
 }
 
-func newClient(user *legoUser, directory string) (*lego.Client, error) {
+func newConfig(user *legoUser, directory string) *lego.Config {
 	legoCfg := lego.NewConfig(user)
 	legoCfg.CADirURL = directory
 	legoCfg.UserAgent = "test-certs-site/1.0"
 
-	return lego.NewClient(legoCfg)
+	return legoCfg
 }
 
-func register(user *legoUser, client *lego.Client, cfg *config.Config, store *storage.Storage) error {
-	reg, err := client.Registration.Register(registration.RegisterOptions{
-		TermsOfServiceAgreed: cfg.ACME.TermsOfServiceAgreed,
-	})
+func newClient(user *legoUser, directory string) (*lego.Client, error) {
+	return lego.NewClient(newConfig(user, directory))
+}
+
+// newSiteClient creates a client which fulfills challenges using the site's configured challenge type.
+// Each site gets its own client, as lego picks whichever challenge it has a provider for.
+func newSiteClient(user *legoUser, directory string, site config.Site, manager *certs.CertManager) (*lego.Client, error) {
+	client, err := newClient(user, directory)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = setProvider(client, site, manager)
+	if err != nil {
+		return nil, fmt.Errorf("setting %s challenge provider: %w", site.ChallengeType, err)
+	}
+
+	return client, nil
+}
+
+// setProvider sets the client's only challenge provider, based on the site's challenge type.
+func setProvider(client *lego.Client, site config.Site, manager *certs.CertManager) error {
+	switch site.ChallengeType {
+	case config.ChallengeHTTP01:
+		return client.Challenge.SetHTTP01Provider(manager.HTTP01Provider())
+	case config.ChallengeDNS01:
+		provider, err := rfc2136.New(site.DNS01)
+		if err != nil {
+			return err
+		}
+
+		return client.Challenge.SetDNS01Provider(provider)
+	default:
+		return client.Challenge.SetTLSALPN01Provider(manager)
+	}
+}
+
+// register a new ACME account, using External Account Binding if it is configured.
+func register(user *legoUser, client *lego.Client, acmeCfg config.ACME, store storage.Storage, keyCreated time.Time) error {
+	var reg *registration.Resource
+	if acmeCfg.EABKeyID != "" {
+		hmacKey, err := eabHMACKey(acmeCfg)
+		if err != nil {
+			return err
+		}
+
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: acmeCfg.TermsOfServiceAgreed,
+			Kid:                  acmeCfg.EABKeyID,
+			HmacEncoded:          hmacKey,
+		})
+		if err != nil {
+			return fmt.Errorf("registering with external account binding: %w", err)
+		}
+	} else {
+		if client.GetExternalAccountRequired() {
+			return errors.New("ACME server requires external account binding, but no EAB key ID is configured")
+		}
+
+		var err error
+		reg, err = client.Registration.Register(registration.RegisterOptions{
+			TermsOfServiceAgreed: acmeCfg.TermsOfServiceAgreed,
+		})
+		if err != nil {
+			return err
+		}
 	}
 	user.reg = reg
 
-	err = store.StoreACME(cfg.ACME.Directory, reg.URI, user.key)
+	err := store.StoreACME(acmeCfg.Directory, storage.Account{
+		URI:        reg.URI,
+		Key:        user.key,
+		EABKeyID:   acmeCfg.EABKeyID,
+		KeyCreated: keyCreated,
+	})
 	if err != nil {
 		return err
 	}
 
-	slog.Info("Created new ACME account", slog.String("directory", cfg.ACME.Directory), slog.String("User", user.reg.URI))
+	slog.Info("Created new ACME account", slog.String("directory", acmeCfg.Directory), slog.String("User", user.reg.URI),
+		slog.String("eabKeyID", acmeCfg.EABKeyID))
 
 	return nil
 }
 
+// eabHMACKey returns the configured EAB HMAC key, reading it from a file if necessary.
+func eabHMACKey(cfg config.ACME) (string, error) {
+	if cfg.EABHMACKeyFile == "" {
+		return cfg.EABHMACKey, nil
+	}
+
+	key, err := os.ReadFile(cfg.EABHMACKeyFile) //nolint:gosec // Reading the configured key file is expected
+	if err != nil {
+		return "", fmt.Errorf("reading EAB HMAC key: %w", err)
+	}
+
+	return strings.TrimSpace(string(key)), nil
+}
+
 // checkRegistration calls the ACME server to see if this account exists.
-func checkRegistration(user *legoUser, client *lego.Client, cfg *config.Config) bool {
-	_, queryErr := client.Registration.QueryRegistration()
+// It returns the account, or nil if it couldn't be found.
+func checkRegistration(user *legoUser, client *lego.Client, directory string) *registration.Resource {
+	reg, queryErr := client.Registration.QueryRegistration()
 	if queryErr != nil {
 		var prob *legoAcme.ProblemDetails
 		if errors.As(queryErr, &prob) && prob.Type == "urn:ietf:params:acme:error:accountDoesNotExist" {
 			// Account is missing from the server.
 			slog.Warn("ACME account missing from server, registering new account",
-				slog.String("directory", cfg.ACME.Directory),
+				slog.String("directory", directory),
 				slog.String("accountURI", user.reg.URI))
 		} else {
 			slog.Warn("Got unexpected error while querying ACME account",
-				slog.String("directory", cfg.ACME.Directory),
+				slog.String("directory", directory),
 				slogErr(queryErr))
 		}
 
-		return false
+		return nil
 	}
 
 	slog.Info("Existing ACME account found", slog.String("accountURI", user.reg.URI))
 
-	return true
+	return reg
 }
 
-// New sets up the ACME client, registering it with the ACME server if one isn't present.
-func New(cfg *config.Config, store *storage.Storage, schedule *scheduler.Schedule, manager *certs.CertManager) error {
-	var user legoUser
+// updateContacts updates the account's contacts if they differ from the configured ones.
+// If no contacts are configured, whatever the account has is left alone.
+func updateContacts(user *legoUser, acmeCfg config.ACME) error {
+	if len(acmeCfg.Contacts) == 0 {
+		return nil
+	}
 
-	client, err := setupLego(cfg, store, user)
+	if slices.Equal(slices.Sorted(slices.Values(user.reg.Body.Contact)), slices.Sorted(slices.Values(acmeCfg.Contacts))) {
+		return nil
+	}
+
+	// lego's Registrar only supports a single email, so use the lower level API to set the whole list.
+	legoCfg := newConfig(user, acmeCfg.Directory)
+	core, err := api.New(legoCfg.HTTPClient, legoCfg.UserAgent, legoCfg.CADirURL, user.reg.URI, user.key)
 	if err != nil {
-		return err
+		return fmt.Errorf("creating ACME API client: %w", err)
 	}
 
+	acct, err := core.Accounts.Update(user.reg.URI, legoAcme.Account{
+		Contact: acmeCfg.Contacts,
+	})
+	if err != nil {
+		return fmt.Errorf("updating ACME account contacts: %w", err)
+	}
+
+	slog.Info("Updated ACME account contacts",
+		slog.String("accountURI", user.reg.URI),
+		slog.Any("old", user.reg.Body.Contact),
+		slog.Any("new", acct.Contact))
+
+	user.reg.Body = acct
+
+	return nil
+}
+
+// firstEmail returns the address of the first mailto: contact, or "" if there isn't one.
+func firstEmail(contacts []string) string {
+	for _, contact := range contacts {
+		email, ok := strings.CutPrefix(contact, "mailto:")
+		if ok {
+			return email
+		}
+	}
+
+	return ""
+}
+
+// New sets up the ACME clients, registering an account with each ACME server if one isn't present.
+// It returns the description of each site's profile from its CA's directory, by the site's valid domain.
+func New(
+	ctx context.Context,
+	cfg *config.Config,
+	store storage.Storage,
+	schedule *scheduler.Schedule,
+	manager *certs.CertManager,
+	registry prometheus.Registerer,
+) (map[string]string, error) {
+	// accounts is a map of directory URL to the account used with it
+	accounts := make(map[string]*account)
+
+	profiles := make(map[string]string)
+
 	crlClient := &http.Client{
 		Timeout: time.Minute,
 	}
 
+	crls := newCRLCache(crlClient, registry)
+
 	crlCheckInterval := time.Duration(cfg.CRLCheckInterval)
 	if crlCheckInterval == 0 {
 		// An hour is a reasonable approximation of how long it might take for a new CRL to be issued.
@@ -164,40 +356,190 @@ func New(cfg *config.Config, store *storage.Storage, schedule *scheduler.Schedul
 		revokeDelay = 25 * time.Hour //nolint:mnd
 	}
 
+	noCRLDecisions := promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "revoked_no_crl_total",
+			Help: "New revoked certificates without a CRL distribution point, by the no-CRL policy applied",
+		},
+		[]string{"domain", "key_type", "policy"},
+	)
+
+	monitorInterval := time.Duration(cfg.RevocationMonitorInterval)
+	switch {
+	case monitorInterval == 0:
+		monitorInterval = time.Hour
+	case monitorInterval < 0:
+		// Disabled, which the checker represents as zero
+		monitorInterval = 0
+	}
+
+	revokedStatus := promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "revoked_certificate_revoked",
+			Help: "1 if the revoked site's current certificate is revoked, 0 if it isn't",
+		},
+		[]string{"domain", "key_type"},
+	)
+
+	var logs ctLogs
+	if cfg.CTLogList != "" {
+		var err error
+		logs, err = loadCTLogs(cfg.CTLogList)
+		if err != nil {
+			return nil, fmt.Errorf("loading CT log list: %w", err)
+		}
+	}
+
+	ctFailures := promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ct_policy_failures_total",
+			Help: "New certificates whose embedded SCTs failed the CT policy",
+		},
+		[]string{"domain", "key_type"},
+	)
+
+	rejected := promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rejected_certificates",
+			Help: "Next certificates rejected in a row, as they couldn't be used. They stop being replaced at 5.",
+		},
+		[]string{"domain", "key_type"},
+	)
+
+	revokeAttempts := cfg.RevokeAttempts
+	if revokeAttempts == 0 {
+		revokeAttempts = 10
+	}
+
 	for _, site := range cfg.Sites {
-		for domain, c := range map[string]checker{
-			site.Domains.Valid: &valid{
-				ari:    client.Certificate,
-				logger: slog.With(slog.String("domain", site.Domains.Valid)),
-			},
-			site.Domains.Revoked: &revoked{
-				http:          crlClient,
-				logger:        slog.With(slog.String("domain", site.Domains.Revoked)),
-				checkInterval: crlCheckInterval,
-				delay:         revokeDelay,
-			},
-			site.Domains.Expired: expired{},
-		} {
-			i := issuer{
-				checker: c,
-
-				domain:   domain,
-				issuerCN: site.IssuerCN,
-				keyType:  site.KeyType,
-				profile:  site.Profile,
-
-				client:   client,
-				logger:   slog.With(slog.String("domain", domain)),
-				manager:  manager,
-				schedule: schedule,
-				store:    store,
+		acmeCfg := cfg.SiteACME(site)
+
+		acct, ok := accounts[acmeCfg.Directory]
+		if !ok {
+			var err error
+			acct, err = newAccount(ctx, acmeCfg, store, schedule, manager)
+			if err != nil {
+				return nil, fmt.Errorf("setting up ACME account for %s: %w", acmeCfg.Directory, err)
+			}
+			accounts[acmeCfg.Directory] = acct
+		}
+
+		_, revocationReason := site.Revocation()
+
+		// Check the profile up front, as the CA would only reject it when issuing
+		if site.Profile != "" {
+			description, err := acct.profile(site.Profile)
+			if err != nil {
+				return nil, fmt.Errorf("site %s: %w", site.Domains.Valid, err)
+			}
+			profiles[site.Domains.Valid] = description
+		}
+
+		// Create the site's client up front, so any problems with it are found at startup
+		client, err := acct.client(site)
+		if err != nil {
+			return nil, err
+		}
+
+		var roots *x509.CertPool
+		if site.TrustedRoots != "" {
+			roots, err = loadRoots(site.TrustedRoots)
+			if err != nil {
+				return nil, fmt.Errorf("loading trusted roots for %s: %w", site.Domains.Valid, err)
+			}
+		}
+
+		pin, err := loadChainPin(site)
+		if err != nil {
+			return nil, fmt.Errorf("loading chain pin for %s: %w", site.Domains.Valid, err)
+		}
+
+		var siteCTLogs ctLogs
+		if site.CTPolicy != "" {
+			siteCTLogs = logs
+		}
+
+		obtainLocks := map[string]*sync.Mutex{
+			site.Domains.Valid:   {},
+			site.Domains.Revoked: {},
+			site.Domains.Expired: {},
+		}
+
+		// Each key type gets its own certificates, issued independently
+		for _, keyType := range site.AllKeyTypes() {
+			for domain, c := range map[string]checker{
+				site.Domains.Valid: &valid{
+					// ARI requests aren't signed, so this client keeps working after a key rollover
+					ari:    client.Certificate,
+					logger: slog.With(slog.String("domain", site.Domains.Valid), slog.String("keyType", keyType)),
+				},
+				site.Domains.Revoked: &revoked{
+					http:          crlClient,
+					crls:          crls,
+					logger:        slog.With(slog.String("domain", site.Domains.Revoked), slog.String("keyType", keyType)),
+					checkInterval: crlCheckInterval,
+					delay:         revokeDelay,
+					reason:        revocationReason,
+					check:         site.RevocationCheck,
+					noCRL:         site.NoCRL(),
+					needsCRL:      site.NeedsCRL(),
+
+					noCRLDecisions: noCRLDecisions.MustCurryWith(prometheus.Labels{"domain": site.Domains.Revoked, "key_type": keyType}),
+
+					monitorInterval: monitorInterval,
+					status:          revokedStatus.WithLabelValues(site.Domains.Revoked, keyType),
+					domain:          site.Domains.Revoked,
+					keyType:         keyType,
+					manager:         manager,
+				},
+				site.Domains.Expired: expired{},
+			} {
+				var alternates []config.AlternateChain
+				if domain == site.Domains.Valid {
+					alternates = site.AlternateChains
+				}
+
+				i := issuer{
+					checker: c,
+
+					domain:   domain,
+					issuerCN: site.IssuerCN,
+					keyType:  keyType,
+					profile:  site.Profile,
+					site:     site,
+					name:     site.CertName(domain, keyType),
+					obtainMu: obtainLocks[domain],
+					roots:    roots,
+					pin:      pin,
+
+					ctLogs:     siteCTLogs,
+					ctPolicy:   site.CTPolicy,
+					ctFailures: ctFailures.WithLabelValues(domain, keyType),
+
+					alternates: alternates,
+
+					revokeAttempts: revokeAttempts,
+					rejected:       rejected.WithLabelValues(domain, keyType),
+
+					account:  acct,
+					logger:   slog.With(slog.String("domain", domain), slog.String("keyType", keyType)),
+					manager:  manager,
+					schedule: schedule,
+					store:    store,
+				}
+
+				// Start each issuer within the next minute, spread out so they don't all run together
+				delay := time.Duration(mathrand.Int64N(int64(time.Minute))) //nolint:gosec // Not security-sensitive use
+				schedule.RunIn(delay, i.start)
 			}
+		}
+	}
 
-			// Start each issuer within the next minute, spread out so they don't all run together
-			delay := time.Duration(mathrand.Int64N(int64(time.Minute))) //nolint:gosec // Not security-sensitive use
-			schedule.RunIn(delay, i.start)
+	for _, acct := range accounts {
+		if acct.cfg.MaxAccountKeyAge != 0 {
+			schedule.RunIn(0, acct.rotate)
 		}
 	}
 
-	return client.Challenge.SetTLSALPN01Provider(manager)
+	return profiles, nil
 }
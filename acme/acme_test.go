@@ -0,0 +1,281 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	legoAcme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/storage"
+)
+
+func TestEABHMACKey(t *testing.T) {
+	t.Parallel()
+
+	key, err := eabHMACKey(config.ACME{EABHMACKey: "c2FsYWQgZHJlc3Npbmc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "c2FsYWQgZHJlc3Npbmc" {
+		t.Fatalf("Expected key from config, got %q", key)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "eab.key")
+	err = os.WriteFile(keyFile, []byte("Y3JvdXRvbnM\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err = eabHMACKey(config.ACME{EABHMACKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "Y3JvdXRvbnM" {
+		t.Fatalf("Expected trimmed key from file, got %q", key)
+	}
+
+	_, err = eabHMACKey(config.ACME{EABHMACKeyFile: filepath.Join(t.TempDir(), "missing.key")})
+	if err == nil {
+		t.Fatal("Expected error reading missing key file")
+	}
+}
+
+func TestFirstEmail(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		contacts []string
+		expected string
+	}{
+		{contacts: nil, expected: ""},
+		{contacts: []string{"tel:+15555550100"}, expected: ""},
+		{contacts: []string{"tel:+15555550100", "mailto:a@example.org", "mailto:b@example.org"}, expected: "a@example.org"},
+	} {
+		got := firstEmail(tc.contacts)
+		if got != tc.expected {
+			t.Errorf("firstEmail(%q) = %q, expected %q", tc.contacts, got, tc.expected)
+		}
+	}
+}
+
+func TestAccountProfile(t *testing.T) {
+	t.Parallel()
+
+	acct := account{
+		cfg: config.ACME{Directory: "https://salad.example/dir"},
+		profiles: map[string]string{
+			"classic":    "The profile you know and love",
+			"shortlived": "Six day certificates",
+		},
+	}
+
+	description, err := acct.profile("shortlived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != "Six day certificates" {
+		t.Fatalf("Expected the profile's description, got %q", description)
+	}
+
+	_, err = acct.profile("shortlivd")
+	if err == nil || !strings.Contains(err.Error(), "which offers: classic, shortlived") {
+		t.Fatalf("Expected an error listing the offered profiles, got %v", err)
+	}
+
+	noProfiles := account{cfg: config.ACME{Directory: "https://salad.example/dir"}}
+
+	_, err = noProfiles.profile("classic")
+	if err == nil {
+		t.Fatal("Expected an error from a CA without profiles")
+	}
+}
+
+// TestUpdateContacts checks the account's contacts are only updated when they differ from the configured ones.
+//
+//nolint:paralleltest // The fake CA sets an environment variable
+func TestUpdateContacts(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updates [][]string
+
+	var url string
+	url = newTestACMEServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "crouton")
+
+		switch r.URL.Path {
+		case "/directory":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"newNonce":   url + "/new-nonce",
+				"newAccount": url + "/new-account",
+				"newOrder":   url + "/new-order",
+			})
+		case "/new-nonce":
+		case "/account/1":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+
+			jws, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256})
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+
+			payload, err := jws.Verify(&key.PublicKey)
+			if err != nil {
+				t.Error(err)
+			}
+
+			var update legoAcme.Account
+			err = json.Unmarshal(payload, &update)
+			if err != nil {
+				t.Error(err)
+			}
+			updates = append(updates, update.Contact)
+
+			_ = json.NewEncoder(w).Encode(legoAcme.Account{Status: "valid", Contact: update.Contact})
+		default:
+			http.NotFound(w, r)
+		}
+	})).URL
+
+	croutons, dressing := "mailto:croutons@salad.example", "mailto:dressing@salad.example"
+
+	for _, tc := range []struct {
+		name                string
+		current, configured []string
+		directory           string
+		wantUpdate          bool
+		wantErr             bool
+	}{
+		{name: "none-configured", current: []string{croutons}},
+		{name: "same", current: []string{croutons}, configured: []string{croutons}},
+		{name: "reordered", current: []string{dressing, croutons}, configured: []string{croutons, dressing}},
+		{name: "changed", current: []string{croutons}, configured: []string{dressing}, wantUpdate: true},
+		{name: "ca-error", current: []string{croutons}, configured: []string{dressing}, directory: "/missing", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			updates = nil
+
+			user := legoUser{
+				reg: &registration.Resource{URI: url + "/account/1", Body: legoAcme.Account{Contact: tc.current}},
+				key: key,
+			}
+
+			directory := url + "/directory"
+			if tc.directory != "" {
+				directory = url + tc.directory
+			}
+
+			err := updateContacts(&user, config.ACME{Directory: directory, Contacts: tc.configured})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.wantUpdate {
+				if len(updates) != 0 {
+					t.Fatalf("Expected no update, got %v", updates)
+				}
+
+				return
+			}
+
+			if len(updates) != 1 || !slices.Equal(updates[0], tc.configured) {
+				t.Fatalf("Expected one update to %v, got %v", tc.configured, updates)
+			}
+			if !slices.Equal(user.reg.Body.Contact, tc.configured) {
+				t.Fatalf("Expected the account's contacts to be %v, got %v", tc.configured, user.reg.Body.Contact)
+			}
+		})
+	}
+}
+
+// TestSetupLegoUnreadableAccount checks an account that exists, but can't be read, isn't replaced by a new one.
+func TestSetupLegoUnreadableAccount(t *testing.T) {
+	t.Parallel()
+
+	const directory = "https://acme.salad/directory"
+
+	dir := t.TempDir()
+
+	encrypted, err := storage.NewFiles(dir, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encrypted.StoreACME(directory, storage.Account{URI: "https://acme.salad/acct/1", Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the key-encryption key, the account can't be read
+	plain, err := storage.NewFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = setupLego(t.Context(), config.ACME{Directory: directory}, plain)
+	if err == nil {
+		t.Fatal("Expected an error for an unreadable account")
+	}
+
+	acct, err := encrypted.ReadACME(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acct.URI != "https://acme.salad/acct/1" || !acct.Key.Equal(key) {
+		t.Fatalf("Expected the stored account to be kept, got %s", acct.URI)
+	}
+}
+
+// newTestACMEServer starts a fake ACME server.
+// lego only talks to CAs over HTTPS, so its clients are made to trust the server's certificate,
+// which means tests using it can't run in parallel.
+func newTestACMEServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LEGO_CA_CERTIFICATES", caFile)
+
+	return srv
+}
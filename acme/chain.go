@@ -0,0 +1,208 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// loadRoots reads a PEM bundle of trusted root certificates.
+func loadRoots(path string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+
+	return roots, nil
+}
+
+// chainPin identifies the root or intermediate a site's chain should include.
+type chainPin struct {
+	// hash is the SHA-256 hash of the pinned certificate's SubjectPublicKeyInfo
+	hash [sha256.Size]byte
+
+	// cert is the pinned certificate, if it was loaded from a file. Nil for a hash pin.
+	cert *x509.Certificate
+}
+
+// loadChainPin returns the site's chain pin, or nil if it doesn't have one.
+func loadChainPin(site config.Site) (*chainPin, error) {
+	switch {
+	case site.ChainSPKIHash != "":
+		hash, err := hex.DecodeString(site.ChainSPKIHash)
+		if err != nil || len(hash) != sha256.Size {
+			// Should be unreachable due to config validation
+			return nil, fmt.Errorf("invalid chain SPKI hash: %s", site.ChainSPKIHash)
+		}
+
+		return &chainPin{hash: [sha256.Size]byte(hash)}, nil
+	case site.ChainCertFile != "":
+		pemBytes, err := os.ReadFile(site.ChainCertFile)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(pemBytes)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("no certificate in %s", site.ChainCertFile)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", site.ChainCertFile, err)
+		}
+
+		return &chainPin{hash: sha256.Sum256(cert.RawSubjectPublicKeyInfo), cert: cert}, nil
+	default:
+		return nil, nil //nolint:nilnil // No pin isn't an error
+	}
+}
+
+// matches returns true if a PEM chain includes the pinned certificate.
+// As the root usually isn't served, it's found by the pinned certificate having signed the top of the chain,
+// or by verifying the chain to roots, if they are given.
+func (p *chainPin) matches(chainPEM []byte, roots *x509.CertPool) (bool, error) {
+	chain, err := parsePEMChain(chainPEM)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range chain {
+		if sha256.Sum256(c.RawSubjectPublicKeyInfo) == p.hash {
+			return true, nil
+		}
+	}
+
+	top := chain[len(chain)-1]
+	if p.cert != nil && top.CheckSignatureFrom(p.cert) == nil {
+		return true, nil
+	}
+
+	if roots == nil {
+		return false, nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   chain[0].NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		// A chain that doesn't verify can't lead to a pinned root
+		return false, nil //nolint:nilerr // Not matching isn't an error
+	}
+
+	for _, v := range verified {
+		if sha256.Sum256(v[len(v)-1].RawSubjectPublicKeyInfo) == p.hash {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parsePEMChain parses a PEM sequence of certificates, leaf first.
+func parsePEMChain(chainPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+
+	rest := bytes.TrimSpace(chainPEM)
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("invalid PEM in certificate chain")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate chain: %w", err)
+		}
+		chain = append(chain, cert)
+
+		rest = bytes.TrimSpace(rest)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("empty certificate chain")
+	}
+
+	return chain, nil
+}
+
+// verifyChain checks the chain that would be served with cert, as the CA may not have honoured PreferredChain.
+// The leaf must cover domain, and the chain must lead to a root in roots with the subject CN issuerCN.
+func verifyChain(cert tls.Certificate, domain, issuerCN string, roots *x509.CertPool) error {
+	served := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parsing certificate chain: %w", err)
+		}
+		served = append(served, parsed)
+	}
+
+	if len(served) == 0 {
+		return fmt.Errorf("empty certificate chain")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range served[1:] {
+		intermediates.AddCert(c)
+	}
+
+	leaf := served[0]
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       domain,
+		Intermediates: intermediates,
+		Roots:         roots,
+		// Verify as of issuance, as the expired site's certificate is meant to expire before it's served
+		CurrentTime: leaf.NotBefore,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("verifying certificate chain: %w", err)
+	}
+
+	for _, chain := range chains {
+		if chain[len(chain)-1].Subject.CommonName == issuerCN && servesChain(served, chain) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate chain doesn't lead to a trusted root named %q", issuerCN)
+}
+
+// servesChain returns true if served is the start of chain, so clients will build chain from it.
+// The root itself may or may not be served.
+func servesChain(served, chain []*x509.Certificate) bool {
+	if len(served) > len(chain) {
+		return false
+	}
+
+	for idx, c := range served {
+		if !c.Equal(chain[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,189 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// testCA is a certificate and key that can issue other certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issueTestCert issues a certificate from parent, or a self-signed one if parent is nil.
+func issueTestCert(t *testing.T, parent *testCA, template *x509.Certificate) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuerCert, issuerKey := template, crypto.Signer(key)
+	if parent != nil {
+		issuerCert, issuerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// caTemplate is a template for a CA certificate named cn.
+func caTemplate(cn string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	t.Parallel()
+
+	root := issueTestCert(t, nil, caTemplate("Salad Root"))
+	otherRoot := issueTestCert(t, nil, caTemplate("Soup Root"))
+	intermediate := issueTestCert(t, root, caTemplate("Salad Intermediate"))
+	otherIntermediate := issueTestCert(t, otherRoot, caTemplate("Soup Intermediate"))
+
+	leafFor := func(parent *testCA, domain string) *x509.Certificate {
+		return issueTestCert(t, parent, &x509.Certificate{
+			DNSNames:    []string{domain},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}).cert
+	}
+
+	leaf := leafFor(intermediate, "valid.example.com")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	roots.AddCert(otherRoot.cert)
+
+	for _, tc := range []struct {
+		name     string
+		chain    []*x509.Certificate
+		issuerCN string
+		wantErr  bool
+	}{
+		{name: "valid", chain: []*x509.Certificate{leaf, intermediate.cert}, issuerCN: "Salad Root"},
+		{name: "root-included", chain: []*x509.Certificate{leaf, intermediate.cert, root.cert}, issuerCN: "Salad Root"},
+		{name: "wrong-root", chain: []*x509.Certificate{leaf, intermediate.cert}, issuerCN: "Soup Root", wantErr: true},
+		{name: "wrong-domain", chain: []*x509.Certificate{leafFor(intermediate, "other.example.com"), intermediate.cert}, issuerCN: "Salad Root", wantErr: true},
+		{name: "missing-intermediate", chain: []*x509.Certificate{leaf}, issuerCN: "Salad Root", wantErr: true},
+		{name: "extra-certificate", chain: []*x509.Certificate{leaf, intermediate.cert, otherIntermediate.cert}, issuerCN: "Salad Root", wantErr: true},
+		{name: "untrusted", chain: []*x509.Certificate{leafFor(otherIntermediate, "valid.example.com"), otherIntermediate.cert}, issuerCN: "Salad Root", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var cert tls.Certificate
+			for _, c := range tc.chain {
+				cert.Certificate = append(cert.Certificate, c.Raw)
+			}
+
+			err := verifyChain(cert, "valid.example.com", tc.issuerCN, roots)
+			if tc.wantErr && err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestChainPin(t *testing.T) {
+	t.Parallel()
+
+	// Both roots have the same name, as a cross-signed hierarchy might
+	root := issueTestCert(t, nil, caTemplate("Salad Root"))
+	crossRoot := issueTestCert(t, nil, caTemplate("Salad Root"))
+	intermediate := issueTestCert(t, root, caTemplate("Salad Intermediate"))
+	leaf := issueTestCert(t, intermediate, &x509.Certificate{DNSNames: []string{"valid.example.com"}})
+
+	var chainPEM []byte
+	for _, c := range []*x509.Certificate{leaf.cert, intermediate.cert} {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+
+	spkiHash := func(c *x509.Certificate) string {
+		hash := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+
+		return hex.EncodeToString(hash[:])
+	}
+
+	certFile := func(c *x509.Certificate) string {
+		path := filepath.Join(t.TempDir(), "pin.pem")
+
+		err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	roots.AddCert(crossRoot.cert)
+
+	for _, tc := range []struct {
+		name  string
+		site  config.Site
+		roots *x509.CertPool
+		match bool
+	}{
+		{name: "intermediate-hash", site: config.Site{ChainSPKIHash: spkiHash(intermediate.cert)}, match: true},
+		{name: "root-hash-unserved", site: config.Site{ChainSPKIHash: spkiHash(root.cert)}},
+		{name: "root-hash-trusted", site: config.Site{ChainSPKIHash: spkiHash(root.cert)}, roots: roots, match: true},
+		{name: "cross-root-hash", site: config.Site{ChainSPKIHash: spkiHash(crossRoot.cert)}, roots: roots},
+		{name: "root-file", site: config.Site{ChainCertFile: certFile(root.cert)}, match: true},
+		{name: "cross-root-file", site: config.Site{ChainCertFile: certFile(crossRoot.cert)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pin, err := loadChainPin(tc.site)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			match, err := pin.matches(chainPEM, tc.roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tc.match {
+				t.Fatalf("Expected match %t, got %t", tc.match, match)
+			}
+		})
+	}
+}
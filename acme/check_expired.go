@@ -16,7 +16,7 @@ func (expired) checkReady(_ context.Context, cert, _ *x509.Certificate) (time.Ti
 // checkRenew for expired certs waits the cert's lifetime after it expired.
 // That way we replace them to keep up with any profile changes, even if we
 // could just keep using one expired cert.
-func (expired) checkRenew(_ context.Context, cert *x509.Certificate) time.Time {
+func (expired) checkRenew(_ context.Context, cert, _ *x509.Certificate) time.Time {
 	return cert.NotAfter.Add(cert.NotAfter.Sub(cert.NotBefore))
 }
 
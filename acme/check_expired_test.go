@@ -31,7 +31,7 @@ func TestCheckExpired(t *testing.T) {
 		t.Fatal("the expired cert won't be ready before it expires")
 	}
 
-	renew := e.checkRenew(t.Context(), &currentCert)
+	renew := e.checkRenew(t.Context(), &currentCert, nil)
 
 	if renew.Before(currentCert.NotAfter) {
 		t.Fatal("the expired cert should be renewed after it expires")
@@ -1,71 +1,288 @@
 package acme
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"slices"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/letsencrypt/test-certs-site/certs"
+	"github.com/letsencrypt/test-certs-site/config"
 )
 
+// maxOCSPResponseSize is the largest OCSP response that will be read. Responses are usually a few hundred bytes.
+const maxOCSPResponseSize = 64 << 10
+
+// errUnusable means a revoked certificate can never satisfy the site's revocation policy, so should be rejected.
+var errUnusable = errors.New("certificate unusable")
+
 type revoked struct {
 	http   *http.Client
+	crls   *crlCache
 	logger *slog.Logger
 
 	checkInterval time.Duration
 	delay         time.Duration
+
+	// reason is the RFC 5280 reason code the certificate should be revoked with
+	reason int
+
+	// check is the site's revocation check policy, saying which of CRL and OCSP must report revoked
+	check string
+
+	// noCRL is the site's policy for certificates without a CRL distribution point
+	noCRL string
+
+	// needsCRL is true if check can't be satisfied without a CRL, so noCRL applies
+	needsCRL bool
+
+	// noCRLDecisions counts noCRL being applied to new certificates, by policy
+	noCRLDecisions *prometheus.CounterVec
+
+	// countedSerial is the serial of the last certificate counted in noCRLDecisions, so each is counted once
+	countedSerial string
+
+	// monitorInterval to recheck the current certificate is still revoked. Zero to disable.
+	monitorInterval time.Duration
+
+	// status is set to 1 while the current certificate is revoked, and 0 if it isn't
+	status prometheus.Gauge
+
+	// domain, keyType and manager are used to stop serving the current certificate if it isn't revoked
+	domain  string
+	keyType string
+	manager *certs.CertManager
 }
 
-func (r *revoked) checkCRL(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
-	if len(cert.CRLDistributionPoints) == 0 {
-		r.logger.Info("No CRL found")
+// checkCRL returns the certificate's entry in the CRL from each of its distribution points.
+// It returns nil if any of them don't list it yet, as relying parties could use any of them.
+func (r *revoked) checkCRL(ctx context.Context, cert, issuer *x509.Certificate) ([]x509.RevocationListEntry, error) {
+	entries := make([]x509.RevocationListEntry, 0, len(cert.CRLDistributionPoints))
 
-		// Assume revoked in the no-CRL case
-		return true, nil
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := fetchCRL(ctx, r.crls, url, issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		idx := slices.IndexFunc(crl.RevokedCertificateEntries, func(entry x509.RevocationListEntry) bool {
+			return entry.SerialNumber.Cmp(cert.SerialNumber) == 0
+		})
+		if idx == -1 {
+			return nil, nil
+		}
+
+		entries = append(entries, crl.RevokedCertificateEntries[idx])
 	}
 
-	url := cert.CRLDistributionPoints[0]
+	return entries, nil
+}
+
+// checkOCSP queries the certificate's OCSP responder, returning its verified response.
+func (r *revoked) checkOCSP(ctx context.Context, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	url := cert.OCSPServer[0]
+
+	ocspReq, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating OCSP request: %w", err)
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(ocspReq))
 	if err != nil {
-		return false, fmt.Errorf("creating HTTP request: %w", err)
+		return nil, fmt.Errorf("creating HTTP request: %w", err)
 	}
 
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
 	resp, err := r.http.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("downloading CRL %q: %w", url, err)
+		return nil, fmt.Errorf("querying OCSP %q: %w", url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("downloading CRL %q: invalid status code: %d", url, resp.StatusCode)
+		return nil, fmt.Errorf("querying OCSP %q: invalid status code: %d", url, resp.StatusCode)
 	}
 
-	der, err := io.ReadAll(resp.Body)
+	// Read one byte past the limit, to tell a response of exactly the maximum size from a larger one
+	der, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize+1))
 	if err != nil {
-		return false, fmt.Errorf("reading CRL %q: %w", url, err)
+		return nil, fmt.Errorf("reading OCSP response %q: %w", url, err)
+	}
+	if len(der) > maxOCSPResponseSize {
+		return nil, fmt.Errorf("OCSP response %q is larger than %d bytes", url, maxOCSPResponseSize)
 	}
 
-	crl, err := x509.ParseRevocationList(der)
+	// This checks the response is for this certificate, and is signed by its issuer
+	ocspResp, err := ocsp.ParseResponseForCert(der, cert, issuer)
 	if err != nil {
-		return false, fmt.Errorf("parsing CRL %q: %w", url, err)
+		return nil, fmt.Errorf("parsing OCSP response %q: %w", url, err)
+	}
+
+	if !ocspResp.NextUpdate.IsZero() && time.Now().After(ocspResp.NextUpdate) {
+		return nil, fmt.Errorf("OCSP response %q is expired at: %s", url, ocspResp.NextUpdate.Format(time.DateTime))
+	}
+
+	return ocspResp, nil
+}
+
+// crlRevoked returns true if the certificate's CRLs all list it with the expected reason.
+func (r *revoked) crlRevoked(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	if len(cert.CRLDistributionPoints) == 0 {
+		// Only reached with the assume-revoked no-CRL policy
+		return true, nil
+	}
+
+	entries, err := r.checkCRL(ctx, cert, issuer)
+	if err != nil || entries == nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		err = r.checkReason("CRL", entry.ReasonCode)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// usesOCSP returns true if the revocation check policy needs OCSP for this certificate.
+// With the "either" policy, OCSP is only used if the certificate has an OCSP URL.
+func usesOCSP(check string, cert *x509.Certificate) bool {
+	switch check {
+	case config.RevocationCheckOCSP, config.RevocationCheckBoth:
+		return true
+	case config.RevocationCheckEither:
+		return len(cert.OCSPServer) > 0
+	default:
+		return false
+	}
+}
+
+// ocspRevoked returns true if the certificate's OCSP responder reports it revoked with the expected reason.
+func (r *revoked) ocspRevoked(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	if len(cert.OCSPServer) == 0 {
+		return false, fmt.Errorf("%w: no OCSP URL in certificate", errUnusable)
 	}
 
-	err = crl.CheckSignatureFrom(issuer)
+	resp, err := r.checkOCSP(ctx, cert, issuer)
+	if err != nil || resp.Status != ocsp.Revoked {
+		return false, err
+	}
+
+	return true, r.checkReason("OCSP", resp.RevocationReason)
+}
+
+// checkReason returns an error if a source reports the wrong revocation reason.
+func (r *revoked) checkReason(source string, reason int) error {
+	if reason != r.reason {
+		// Relying parties would see the wrong reason, so this certificate can't be used
+		return fmt.Errorf("%w: %s has revocation reason code %d, expected %d", errUnusable, source, reason, r.reason)
+	}
+
+	return nil
+}
+
+// appliesNoCRL returns true if the no-CRL policy decides how a certificate is checked.
+func (r *revoked) appliesNoCRL(cert *x509.Certificate) bool {
+	return r.needsCRL && len(cert.CRLDistributionPoints) == 0
+}
+
+// applyNoCRL returns the revocation check policy to use for a certificate.
+// If the policy needs a CRL and the certificate has none, the no-CRL policy decides.
+func (r *revoked) applyNoCRL(cert *x509.Certificate) (string, error) {
+	if !r.appliesNoCRL(cert) {
+		if len(cert.CRLDistributionPoints) == 0 {
+			// OCSP alone can satisfy the policy, so it doesn't need a CRL
+			return config.RevocationCheckOCSP, nil
+		}
+
+		return r.check, nil
+	}
+
+	switch r.noCRL {
+	case config.NoCRLAssumeRevoked:
+		return r.check, nil
+	case config.NoCRLRequireOCSP:
+		return config.RevocationCheckOCSP, nil
+	default:
+		return "", fmt.Errorf("%w: no CRL distribution point", errUnusable)
+	}
+}
+
+// countNoCRL counts and logs the no-CRL policy being applied to a new certificate.
+// It's checked again until it's revoked, so it's only counted the first time.
+func (r *revoked) countNoCRL(cert *x509.Certificate) {
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	if !r.appliesNoCRL(cert) || serial == r.countedSerial {
+		return
+	}
+
+	r.countedSerial = serial
+	r.noCRLDecisions.WithLabelValues(r.noCRL).Inc()
+	r.logger.Warn("No CRL found: applying no-CRL policy", slog.String("policy", r.noCRL))
+}
+
+// isRevoked returns true if the sources required by the site's policy report the certificate revoked.
+// It returns an error wrapping errUnusable if the certificate can't be used, or any other error if
+// a source couldn't be checked and the others don't say it's revoked.
+func (r *revoked) isRevoked(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	check, err := r.applyNoCRL(cert)
 	if err != nil {
-		return false, fmt.Errorf("validating CRL: %w", err)
+		return false, err
+	}
+
+	var crlRevoked, ocspRevoked bool
+	var errs []error
+
+	if check != config.RevocationCheckOCSP {
+		crlRevoked, err = r.crlRevoked(ctx, cert, issuer)
+		if errors.Is(err, errUnusable) {
+			return false, err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("checking CRL: %w", err))
+		}
+	}
+
+	if usesOCSP(check, cert) {
+		ocspRevoked, err = r.ocspRevoked(ctx, cert, issuer)
+		if errors.Is(err, errUnusable) {
+			return false, err
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("checking OCSP: %w", err))
+		}
+	}
+
+	var isRevoked bool
+	switch check {
+	case config.RevocationCheckOCSP:
+		isRevoked = ocspRevoked
+	case config.RevocationCheckEither:
+		isRevoked = crlRevoked || ocspRevoked
+	case config.RevocationCheckBoth:
+		isRevoked = crlRevoked && ocspRevoked
+	default:
+		isRevoked = crlRevoked
 	}
 
-	if time.Now().After(crl.NextUpdate) {
-		return false, fmt.Errorf("CRL %q is expired at: %s", url, crl.NextUpdate.Format(time.DateTime))
+	if !isRevoked && len(errs) > 0 {
+		return false, errors.Join(errs...)
 	}
 
-	return slices.ContainsFunc(crl.RevokedCertificateEntries, func(entry x509.RevocationListEntry) bool {
-		return entry.SerialNumber.Cmp(cert.SerialNumber) == 0
-	}), nil
+	return isRevoked, nil
 }
 
 func (r *revoked) checkReady(ctx context.Context, cert, issuer *x509.Certificate) (time.Time, error) {
@@ -82,14 +299,19 @@ func (r *revoked) checkReady(ctx context.Context, cert, issuer *x509.Certificate
 		return delayUntil, nil
 	}
 
-	isRevoked, err := r.checkCRL(ctx, cert, issuer)
+	r.countNoCRL(cert)
+
+	ready, err := r.isRevoked(ctx, cert, issuer)
+	if errors.Is(err, errUnusable) {
+		return time.Time{}, err
+	}
 	if err != nil {
-		r.logger.Warn("Error checking CRL", slogErr(err))
+		r.logger.Warn("Error checking revocation", slogErr(err))
 
 		return now.Add(r.checkInterval), nil
 	}
 
-	if !isRevoked {
+	if !ready {
 		retryAt := now.Add(r.checkInterval)
 		r.logger.Info("Certificate not yet revoked: will recheck", slog.Time("at", retryAt))
 
@@ -100,11 +322,53 @@ func (r *revoked) checkReady(ctx context.Context, cert, issuer *x509.Certificate
 	return time.Time{}, nil
 }
 
-// checkRenew for a revoked certificate always returns the midpoint of the
-// cert's lifetime. We can't use ARI because it'll want to always replace a
-// revoked certificate immediately.
-func (r *revoked) checkRenew(_ context.Context, cert *x509.Certificate) time.Time {
-	return halfTime(cert)
+// checkRenew for a revoked certificate returns the midpoint of the cert's
+// lifetime. We can't use ARI because it'll want to always replace a revoked
+// certificate immediately.
+// If monitoring is enabled, it also checks the certificate is still revoked, rechecking every
+// monitorInterval. If it isn't, the certificate stops being served and is renewed right away.
+func (r *revoked) checkRenew(ctx context.Context, cert, issuer *x509.Certificate) time.Time {
+	renewAt := halfTime(cert)
+	if r.monitorInterval == 0 || issuer == nil {
+		return renewAt
+	}
+
+	isRevoked, err := r.isRevoked(ctx, cert, issuer)
+	switch {
+	case errors.Is(err, errUnusable):
+		r.logger.Error("Current certificate is unusable: replacing it", slogErr(err))
+		r.replace()
+
+		return time.Time{}
+	case err != nil:
+		// Don't replace the certificate just because a check failed
+		r.logger.Warn("Error checking current certificate is still revoked", slogErr(err))
+	case !isRevoked:
+		r.logger.Error("Current certificate is no longer revoked: replacing it")
+		r.replace()
+
+		return time.Time{}
+	default:
+		r.status.Set(1)
+	}
+
+	recheckAt := time.Now().Add(r.monitorInterval)
+	if recheckAt.Before(renewAt) {
+		return recheckAt
+	}
+
+	return renewAt
+}
+
+// replace stops serving the current certificate, so it's renewed.
+// It's removed from storage too, so it isn't served or checked again after it's replaced.
+func (r *revoked) replace() {
+	r.status.Set(0)
+
+	err := r.manager.RemoveCertificate(r.domain, r.keyType)
+	if err != nil {
+		r.logger.Error("Removing current certificate", slogErr(err))
+	}
 }
 
 func (r *revoked) shouldRevoke() bool {
@@ -6,14 +6,59 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
 	"log/slog"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/letsencrypt/test-certs-site/certs"
+	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/storage"
 )
 
+// storeTestCurrent stores a self-signed current certificate for domain.
+func storeTestCurrent(t *testing.T, store storage.Storage, domain string) {
+	t.Helper()
+
+	key, err := store.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.StoreNextCert(domain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCheckRevokedRenew(t *testing.T) {
 	t.Parallel()
 
@@ -22,7 +67,7 @@ func TestCheckRevokedRenew(t *testing.T) {
 	minuteAhead := now.Add(time.Minute)
 	hourAhead := now.Add(time.Hour)
 
-	renew := r.checkRenew(t.Context(), &x509.Certificate{NotBefore: now, NotAfter: hourAhead})
+	renew := r.checkRenew(t.Context(), &x509.Certificate{NotBefore: now, NotAfter: hourAhead}, nil)
 	if renew.Before(minuteAhead) {
 		t.Fatal("renew time should be in the future")
 	}
@@ -34,7 +79,7 @@ func TestCheckRevokedRenew(t *testing.T) {
 func TestCheckRevoked(t *testing.T) {
 	t.Parallel()
 
-	caCert, crlData := createMocks(t)
+	caCert, _, crlData := createMocks(t)
 	crlPath := "/test.crl"
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -48,9 +93,11 @@ func TestCheckRevoked(t *testing.T) {
 
 	r := &revoked{
 		http:          server.Client(),
+		crls:          newCRLCache(server.Client(), nil),
 		logger:        slog.Default(),
 		checkInterval: time.Minute,
 		delay:         time.Hour,
+		reason:        1,
 	}
 
 	if !r.shouldRevoke() {
@@ -95,9 +142,275 @@ func TestCheckRevoked(t *testing.T) {
 	if !readyTime.IsZero() {
 		t.Fatal("expected revoked cert to be ready")
 	}
+
+	_, err = r.checkReady(t.Context(), &x509.Certificate{
+		SerialNumber:          big.NewInt(23456),
+		NotBefore:             now.Add(-r.delay),
+		NotAfter:              now.Add(time.Hour),
+		CRLDistributionPoints: []string{server.URL + crlPath},
+	}, caCert)
+	if err == nil {
+		t.Fatal("expected cert revoked with the wrong reason to be thrown out")
+	}
 }
 
-func createMocks(t *testing.T) (*x509.Certificate, []byte) {
+func TestCheckRevokedOCSP(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey, crlData := createMocks(t)
+
+	// The OCSP responder reports 12345 and 23456 revoked with keyCompromise, and anything else good
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/test.crl" {
+			_, _ = w.Write(crlData)
+
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if req.SerialNumber.Cmp(big.NewInt(12345)) == 0 || req.SerialNumber.Cmp(big.NewInt(23456)) == 0 {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now()
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+
+		resp, err := ocsp.CreateResponse(caCert, caCert, template, caKey)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+
+	testCert := func(serial int64, withCRL, withOCSP bool) *x509.Certificate {
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+		}
+		if withCRL {
+			cert.CRLDistributionPoints = []string{server.URL + "/test.crl"}
+		}
+		if withOCSP {
+			cert.OCSPServer = []string{server.URL + "/ocsp"}
+		}
+
+		return cert
+	}
+
+	for _, tc := range []struct {
+		name     string
+		check    string
+		noCRL    string
+		cert     *x509.Certificate
+		ready    bool
+		unusable bool
+	}{
+		// 12345 is revoked in both the CRL and OCSP
+		{name: "crl-revoked", check: config.RevocationCheckCRL, cert: testCert(12345, true, true), ready: true},
+		{name: "ocsp-revoked", check: config.RevocationCheckOCSP, cert: testCert(12345, true, true), ready: true},
+		{name: "both-revoked", check: config.RevocationCheckBoth, cert: testCert(12345, true, true), ready: true},
+		// 1111 is in neither
+		{name: "ocsp-good", check: config.RevocationCheckOCSP, cert: testCert(1111, true, true)},
+		{name: "either-good", check: config.RevocationCheckEither, cert: testCert(1111, true, true)},
+		// 23456 is in the CRL with the wrong reason, but OCSP has the right one
+		{name: "ocsp-only", check: config.RevocationCheckOCSP, cert: testCert(23456, true, true), ready: true},
+		{name: "both-wrong-reason", check: config.RevocationCheckBoth, cert: testCert(23456, true, true), unusable: true},
+		// Without an OCSP URL, OCSP is skipped if it's optional
+		{name: "either-no-ocsp", check: config.RevocationCheckEither, cert: testCert(12345, true, false), ready: true},
+		{name: "ocsp-no-ocsp", check: config.RevocationCheckOCSP, cert: testCert(12345, true, false), unusable: true},
+		// Without a CRL, the no-CRL policy decides
+		{name: "no-crl-refuse", check: config.RevocationCheckCRL, noCRL: config.NoCRLRefuse, cert: testCert(12345, false, true), unusable: true},
+		{name: "no-crl-assume", check: config.RevocationCheckCRL, noCRL: config.NoCRLAssumeRevoked, cert: testCert(1111, false, true), ready: true},
+		{name: "no-crl-ocsp", check: config.RevocationCheckCRL, noCRL: config.NoCRLRequireOCSP, cert: testCert(12345, false, true), ready: true},
+		{name: "no-crl-ocsp-good", check: config.RevocationCheckBoth, noCRL: config.NoCRLRequireOCSP, cert: testCert(1111, false, true)},
+		{name: "no-crl-no-ocsp", check: config.RevocationCheckCRL, noCRL: config.NoCRLRequireOCSP, cert: testCert(12345, false, false), unusable: true},
+		{name: "no-crl-ocsp-check", check: config.RevocationCheckOCSP, noCRL: config.NoCRLRefuse, cert: testCert(12345, false, true), ready: true},
+		// Without a CRL, the either policy is satisfied by OCSP alone
+		{name: "no-crl-either", check: config.RevocationCheckEither, noCRL: config.NoCRLRefuse, cert: testCert(12345, false, true), ready: true},
+		{name: "no-crl-either-good", check: config.RevocationCheckEither, noCRL: config.NoCRLAssumeRevoked, cert: testCert(1111, false, true)},
+		{name: "no-crl-either-no-ocsp", check: config.RevocationCheckEither, noCRL: config.NoCRLRefuse, cert: testCert(12345, false, false), unusable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := &revoked{
+				http:          server.Client(),
+				crls:          newCRLCache(server.Client(), nil),
+				logger:        slog.Default(),
+				checkInterval: time.Minute,
+				reason:        ocsp.KeyCompromise,
+				check:         tc.check,
+				noCRL:         tc.noCRL,
+				needsCRL:      config.Site{RevocationCheck: tc.check}.NeedsCRL(),
+
+				noCRLDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"policy"}),
+			}
+
+			readyTime, err := r.checkReady(t.Context(), tc.cert, caCert)
+
+			// The no-CRL policy is only applied if a CRL is needed and missing, and counted once per certificate
+			_, _ = r.checkReady(t.Context(), tc.cert, caCert)
+
+			var wantCount float64
+			if tc.check != config.RevocationCheckOCSP && tc.check != config.RevocationCheckEither &&
+				len(tc.cert.CRLDistributionPoints) == 0 {
+				wantCount = 1
+			}
+			if got := testutil.ToFloat64(r.noCRLDecisions.WithLabelValues(tc.noCRL)); got != wantCount {
+				t.Errorf("Expected the no-CRL policy to be counted %.0f times, got %.0f", wantCount, got)
+			}
+
+			if tc.unusable {
+				if !errors.Is(err, errUnusable) {
+					t.Fatalf("Expected certificate to be unusable, got %v", err)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if readyTime.IsZero() != tc.ready {
+				t.Fatalf("Expected ready %t, got ready time %v", tc.ready, readyTime)
+			}
+		})
+	}
+}
+
+// TestCheckOCSPTooLarge checks an OCSP response over the size limit isn't read.
+func TestCheckOCSPTooLarge(t *testing.T) {
+	t.Parallel()
+
+	caCert, _, _ := createMocks(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(make([]byte, maxOCSPResponseSize+1))
+	}))
+	t.Cleanup(server.Close)
+
+	r := &revoked{http: server.Client()}
+
+	_, err := r.checkOCSP(t.Context(), &x509.Certificate{
+		SerialNumber: big.NewInt(12345),
+		OCSPServer:   []string{server.URL + "/ocsp"},
+	}, caCert)
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("Expected an error for a large response, got %v", err)
+	}
+}
+
+func TestCheckRevokedMonitor(t *testing.T) {
+	t.Parallel()
+
+	caCert, _, crlData := createMocks(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(crlData)
+	}))
+	t.Cleanup(server.Close)
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := certs.New(&config.Config{}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name    string
+		serial  int64
+		revoked bool
+	}{
+		{name: "still-revoked", serial: 12345, revoked: true},
+		{name: "not-revoked", serial: 1111},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			status := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})
+
+			domain := tc.name + ".example.com"
+			storeTestCurrent(t, store, domain)
+
+			r := &revoked{
+				http:            server.Client(),
+				crls:            newCRLCache(server.Client(), nil),
+				logger:          slog.Default(),
+				reason:          1,
+				monitorInterval: time.Minute,
+				status:          status,
+				domain:          domain,
+				manager:         manager,
+				noCRLDecisions:  prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"policy"}),
+			}
+
+			renew := r.checkRenew(t.Context(), &x509.Certificate{
+				SerialNumber:          big.NewInt(tc.serial),
+				NotBefore:             now.Add(-time.Hour),
+				NotAfter:              now.Add(time.Hour),
+				CRLDistributionPoints: []string{server.URL + "/test.crl"},
+			}, caCert)
+
+			if !tc.revoked {
+				if !renew.IsZero() {
+					t.Fatalf("Expected an unrevoked certificate to be renewed now, got %v", renew)
+				}
+				if testutil.ToFloat64(status) != 0 {
+					t.Fatal("Expected status 0 for an unrevoked certificate")
+				}
+
+				// It's removed from storage, so it isn't served or checked again after a restart
+				_, err := store.ReadCurrent(domain)
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("Expected the unrevoked certificate to be removed, got %v", err)
+				}
+
+				return
+			}
+
+			if renew.After(now.Add(r.monitorInterval + time.Second)) {
+				t.Fatalf("Expected a recheck within the monitor interval, got %v", renew)
+			}
+			if testutil.ToFloat64(status) != 1 {
+				t.Fatal("Expected status 1 for a revoked certificate")
+			}
+
+			_, err := store.ReadCurrent(domain)
+			if err != nil {
+				t.Fatalf("Expected the revoked certificate to be kept, got %v", err)
+			}
+		})
+	}
+}
+
+func createMocks(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
 	t.Helper()
 	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -133,6 +446,12 @@ func createMocks(t *testing.T) (*x509.Certificate, []byte) {
 			{
 				SerialNumber:   big.NewInt(12345),
 				RevocationTime: time.Now(),
+				ReasonCode:     1,
+			},
+			{
+				SerialNumber:   big.NewInt(23456),
+				RevocationTime: time.Now(),
+				ReasonCode:     4,
 			},
 		},
 	}
@@ -142,5 +461,5 @@ func createMocks(t *testing.T) (*x509.Certificate, []byte) {
 		t.Fatal(err)
 	}
 
-	return caCert, crlData
+	return caCert, caKey, crlData
 }
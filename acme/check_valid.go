@@ -29,7 +29,7 @@ func (v *valid) checkReady(_ context.Context, cert, _ *x509.Certificate) (time.T
 	return time.Time{}, nil
 }
 
-func (v *valid) checkRenew(_ context.Context, cert *x509.Certificate) time.Time {
+func (v *valid) checkRenew(_ context.Context, cert, _ *x509.Certificate) time.Time {
 	resp, err := v.ari.GetRenewalInfo(certificate.RenewalInfoRequest{
 		Cert: cert,
 	})
@@ -40,7 +40,7 @@ func TestCheckValid(t *testing.T) {
 		NotAfter:     now.Add(time.Minute),
 	}
 
-	at := v.checkRenew(t.Context(), &currentCert)
+	at := v.checkRenew(t.Context(), &currentCert, nil)
 	if at.After(currentCert.NotAfter) {
 		t.Fatal("renew time is after expiry date")
 	}
@@ -85,7 +85,7 @@ func TestValidARI(t *testing.T) {
 		}},
 	}
 
-	renewTime := v.checkRenew(t.Context(), &x509.Certificate{})
+	renewTime := v.checkRenew(t.Context(), &x509.Certificate{}, nil)
 
 	if renewTime.Before(minuteAhead) {
 		t.Fatalf("readyTime should not be before window: %v %v", renewTime, minuteAhead)
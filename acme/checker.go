@@ -17,9 +17,9 @@ type checker interface {
 	// Checks CRLs for revoked certs.
 	checkReady(ctx context.Context, cert, issuer *x509.Certificate) (time.Time, error)
 
-	// checkRenew returns when we should renew it.
-	// Checks ARI for valid certs.
-	checkRenew(ctx context.Context, cert *x509.Certificate) time.Time
+	// checkRenew returns when we should renew it. The issuer is nil if it couldn't be found.
+	// Checks ARI for valid certs, and that revoked certs are still revoked.
+	checkRenew(ctx context.Context, cert, issuer *x509.Certificate) time.Time
 
 	// shouldRevoke returns true if this certificate should be revoked.
 	// Returns true for revoked certs, and false otherwise.
@@ -0,0 +1,88 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// oidIssuingDistributionPoint is the CRL extension identifying which shard of a partitioned CRL it is.
+var oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+
+// issuingDistributionPoint is the RFC 5280 section 5.2.5 extension.
+type issuingDistributionPoint struct {
+	DistributionPoint          distributionPointName `asn1:"optional,tag:0"`
+	OnlyContainsUserCerts      bool                  `asn1:"optional,tag:1"`
+	OnlyContainsCACerts        bool                  `asn1:"optional,tag:2"`
+	OnlySomeReasons            asn1.BitString        `asn1:"optional,tag:3"`
+	IndirectCRL                bool                  `asn1:"optional,tag:4"`
+	OnlyContainsAttributeCerts bool                  `asn1:"optional,tag:5"`
+}
+
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+// uriTag is the GeneralName tag for a uniformResourceIdentifier.
+const uriTag = 6
+
+// fetchCRL gets a CRL from the cache, checking it is signed by the issuer, current, and covers the URL it was fetched from.
+func fetchCRL(ctx context.Context, crls *crlCache, url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	crl, err := crls.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = crl.CheckSignatureFrom(issuer)
+	if err != nil {
+		return nil, fmt.Errorf("validating CRL: %w", err)
+	}
+
+	if time.Now().After(crl.NextUpdate) {
+		return nil, fmt.Errorf("CRL %q is expired at: %s", url, crl.NextUpdate.Format(time.DateTime))
+	}
+
+	err = checkIDP(crl, url)
+	if err != nil {
+		return nil, fmt.Errorf("CRL %q: %w", url, err)
+	}
+
+	return crl, nil
+}
+
+// checkIDP checks a CRL's Issuing Distribution Point says it is the shard at url.
+// A CRL without an IDP is a complete CRL, so covers every URL.
+func checkIDP(crl *x509.RevocationList, url string) error {
+	idx := slices.IndexFunc(crl.Extensions, func(ext pkix.Extension) bool {
+		return ext.Id.Equal(oidIssuingDistributionPoint)
+	})
+	if idx == -1 {
+		return nil
+	}
+
+	var idp issuingDistributionPoint
+	rest, err := asn1.Unmarshal(crl.Extensions[idx].Value, &idp)
+	if err != nil {
+		return fmt.Errorf("parsing issuing distribution point: %w", err)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("trailing data after issuing distribution point")
+	}
+
+	if idp.OnlyContainsCACerts || idp.OnlyContainsAttributeCerts {
+		return fmt.Errorf("issuing distribution point doesn't cover end-entity certificates")
+	}
+
+	for _, name := range idp.DistributionPoint.FullName {
+		if name.Class == asn1.ClassContextSpecific && name.Tag == uriTag && string(name.Bytes) == url {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("issuing distribution point doesn't match")
+}
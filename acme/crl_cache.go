@@ -0,0 +1,170 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// crlCacheMaxAge is how long a cached CRL is used before revalidating it with the server.
+	// It's short, so a newly revoked certificate is seen soon after the CA publishes a new CRL,
+	// but long enough that sites checking at the same time share a download.
+	crlCacheMaxAge = 5 * time.Minute
+
+	// maxCRLSize is the largest CRL that will be downloaded.
+	// Sharded CRLs are far smaller, but a CA's whole CRL can be tens of megabytes.
+	maxCRLSize = 64 << 20
+)
+
+// crlCache holds downloaded CRLs by URL. It's shared by all revoked sites,
+// so sites with certificates from the same issuer don't each download its CRLs.
+type crlCache struct {
+	http    *http.Client
+	maxAge  time.Duration
+	maxSize int64
+
+	hits        prometheus.Counter
+	downloaded  prometheus.Counter
+	parseErrors prometheus.Counter
+
+	// mu protects entries
+	mu      sync.Mutex
+	entries map[string]*crlCacheEntry
+}
+
+// crlCacheEntry is a cached CRL, along with the validators to check it's still current.
+type crlCacheEntry struct {
+	// mu is held while fetching, so concurrent callers share one download
+	mu sync.Mutex
+
+	crl          *x509.RevocationList
+	etag         string
+	lastModified string
+
+	// checked is when the server last confirmed crl is current
+	checked time.Time
+}
+
+// newCRLCache creates an empty cache, registering its metrics.
+func newCRLCache(client *http.Client, registry prometheus.Registerer) *crlCache {
+	return &crlCache{
+		http:    client,
+		maxAge:  crlCacheMaxAge,
+		maxSize: maxCRLSize,
+		hits: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "crl_cache_hits_total",
+			Help: "CRL fetches answered from the cache, including those the server said were not modified",
+		}),
+		downloaded: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "crl_downloaded_bytes_total",
+			Help: "Bytes of CRLs downloaded",
+		}),
+		parseErrors: promauto.With(registry).NewCounter(prometheus.CounterOpts{
+			Name: "crl_parse_errors_total",
+			Help: "Downloaded CRLs which couldn't be parsed",
+		}),
+		entries: make(map[string]*crlCacheEntry),
+	}
+}
+
+// get returns the CRL at url. A cached copy is used until maxAge or its NextUpdate,
+// after which it's revalidated with a conditional GET, or downloaded again once expired.
+// The CRL isn't validated, which is left to the caller.
+func (c *crlCache) get(ctx context.Context, url string) (*x509.RevocationList, error) {
+	entry := c.entry(url)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := time.Now()
+
+	if entry.crl != nil && now.After(entry.crl.NextUpdate) {
+		// The CA has published a new CRL by now, so there's nothing to revalidate
+		entry.crl = nil
+		entry.etag = ""
+		entry.lastModified = ""
+	}
+
+	if entry.crl != nil && now.Sub(entry.checked) < c.maxAge {
+		c.hits.Inc()
+
+		return entry.crl, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating HTTP request: %w", err)
+	}
+
+	if entry.crl != nil {
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading CRL %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry.crl != nil {
+		entry.checked = now
+		c.hits.Inc()
+
+		return entry.crl, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading CRL %q: invalid status code: %d", url, resp.StatusCode)
+	}
+
+	// Read one byte past the limit, to tell a CRL of exactly maxSize from a larger one
+	der, err := io.ReadAll(io.LimitReader(resp.Body, c.maxSize+1))
+	c.downloaded.Add(float64(len(der)))
+	if err != nil {
+		return nil, fmt.Errorf("reading CRL %q: %w", url, err)
+	}
+	if int64(len(der)) > c.maxSize {
+		return nil, fmt.Errorf("CRL %q is larger than %d bytes", url, c.maxSize)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		c.parseErrors.Inc()
+
+		return nil, fmt.Errorf("parsing CRL %q: %w", url, err)
+	}
+
+	entry.crl = crl
+	entry.etag = resp.Header.Get("ETag")
+	entry.lastModified = resp.Header.Get("Last-Modified")
+	entry.checked = now
+
+	return crl, nil
+}
+
+// entry returns the cache entry for url, adding an empty one if there isn't one yet.
+func (c *crlCache) entry(url string) *crlCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[url]
+	if !ok {
+		entry = &crlCacheEntry{}
+		c.entries[url] = entry
+	}
+
+	return entry
+}
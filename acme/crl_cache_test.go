@@ -0,0 +1,122 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCRLCache(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey, _ := createMocks(t)
+
+	crl := func(nextUpdate time.Time) []byte {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Hour),
+			NextUpdate: nextUpdate,
+		}, caCert, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return der
+	}
+
+	current := crl(time.Now().Add(time.Hour))
+	expired := crl(time.Now().Add(-time.Minute))
+
+	var downloads, notModified atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/current.crl":
+			w.Header().Set("ETag", `"current"`)
+			if r.Header.Get("If-None-Match") == `"current"` {
+				notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+
+				return
+			}
+			downloads.Add(1)
+			_, _ = w.Write(current)
+		case "/expired.crl":
+			w.Header().Set("ETag", `"expired"`)
+			if r.Header.Get("If-None-Match") != "" {
+				t.Error("Expired CRL shouldn't be revalidated")
+			}
+			downloads.Add(1)
+			_, _ = w.Write(expired)
+		case "/garbage.crl":
+			_, _ = w.Write([]byte("not a CRL"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cache := newCRLCache(server.Client(), nil)
+
+	// The first fetch downloads, and the second is served from the cache
+	for range 2 {
+		_, err := cache.get(t.Context(), server.URL+"/current.crl")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads.Load() != 1 || notModified.Load() != 0 {
+		t.Fatalf("Expected one download, got %d downloads and %d revalidations", downloads.Load(), notModified.Load())
+	}
+
+	// Once past maxAge, the CRL is revalidated instead of downloaded again
+	cache.maxAge = 0
+	_, err := cache.get(t.Context(), server.URL+"/current.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downloads.Load() != 1 || notModified.Load() != 1 {
+		t.Fatalf("Expected a revalidation, got %d downloads and %d revalidations", downloads.Load(), notModified.Load())
+	}
+	if hits := testutil.ToFloat64(cache.hits); hits != 2 {
+		t.Fatalf("Expected 2 cache hits, got %f", hits)
+	}
+	if size := testutil.ToFloat64(cache.downloaded); size != float64(len(current)) {
+		t.Fatalf("Expected %d bytes downloaded, got %f", len(current), size)
+	}
+
+	// A CRL past its NextUpdate is downloaded again each time
+	cache.maxAge = time.Hour
+	for range 2 {
+		_, err := cache.get(t.Context(), server.URL+"/expired.crl")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads.Load() != 3 {
+		t.Fatalf("Expected expired CRL to be downloaded each time, got %d downloads in total", downloads.Load())
+	}
+
+	_, err = cache.get(t.Context(), server.URL+"/garbage.crl")
+	if err == nil {
+		t.Fatal("Expected an error parsing garbage")
+	}
+	if parseErrors := testutil.ToFloat64(cache.parseErrors); parseErrors != 1 {
+		t.Fatalf("Expected 1 parse error, got %f", parseErrors)
+	}
+
+	cache.maxSize = int64(len(current)) - 1
+	cache.maxAge = 0
+	cache.entries = make(map[string]*crlCacheEntry)
+	_, err = cache.get(t.Context(), server.URL+"/current.crl")
+	if err == nil {
+		t.Fatal("Expected an error for a CRL over the size limit")
+	}
+}
@@ -0,0 +1,124 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// idpExtension returns an Issuing Distribution Point extension for url.
+func idpExtension(t *testing.T, url string) pkix.Extension {
+	t.Helper()
+
+	value, err := asn1.Marshal(issuingDistributionPoint{
+		DistributionPoint: distributionPointName{
+			FullName: []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: uriTag, Bytes: []byte(url)}},
+		},
+		OnlyContainsUserCerts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pkix.Extension{Id: oidIssuingDistributionPoint, Critical: true, Value: value}
+}
+
+func TestCheckCRLShards(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey, _ := createMocks(t)
+
+	// shards maps each path to the shard it claims to be in its IDP, and the serials it lists
+	shards := map[string]struct {
+		idp     string
+		serials []int64
+	}{
+		"/1.crl":     {idp: "/1.crl", serials: []int64{100, 200}},
+		"/2.crl":     {idp: "/2.crl", serials: []int64{100}},
+		"/wrong.crl": {idp: "/1.crl", serials: []int64{100, 200}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shard, ok := shards[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		template := &x509.RevocationList{
+			Number:          big.NewInt(1),
+			ThisUpdate:      time.Now().Add(-time.Hour),
+			NextUpdate:      time.Now().Add(time.Hour),
+			ExtraExtensions: []pkix.Extension{idpExtension(t, "http://"+r.Host+shard.idp)},
+		}
+		for _, serial := range shard.serials {
+			template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+				SerialNumber:   big.NewInt(serial),
+				RevocationTime: time.Now(),
+				ReasonCode:     1,
+			})
+		}
+
+		crl, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, _ = w.Write(crl)
+	}))
+	t.Cleanup(server.Close)
+
+	r := &revoked{
+		http:   server.Client(),
+		crls:   newCRLCache(server.Client(), nil),
+		logger: slog.Default(),
+		reason: 1,
+	}
+
+	for _, tc := range []struct {
+		name    string
+		serial  int64
+		paths   []string
+		revoked bool
+		wantErr bool
+	}{
+		{name: "one-shard", serial: 200, paths: []string{"/1.crl"}, revoked: true},
+		{name: "all-shards", serial: 100, paths: []string{"/1.crl", "/2.crl"}, revoked: true},
+		{name: "missing-from-one", serial: 200, paths: []string{"/1.crl", "/2.crl"}},
+		{name: "wrong-shard", serial: 100, paths: []string{"/wrong.crl"}, wantErr: true},
+		{name: "unavailable", serial: 100, paths: []string{"/1.crl", "/missing.crl"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cert := &x509.Certificate{SerialNumber: big.NewInt(tc.serial)}
+			for _, path := range tc.paths {
+				cert.CRLDistributionPoints = append(cert.CRLDistributionPoints, server.URL+path)
+			}
+
+			isRevoked, err := r.crlRevoked(t.Context(), cert, caCert)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if isRevoked != tc.revoked {
+				t.Fatalf("Expected revoked %t, got %t", tc.revoked, isRevoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// oidSCTList is the extension holding a certificate's embedded SCTs, from RFC 6962 section 3.3.
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+const (
+	// maxShortLifetime is the longest a certificate can be valid for and need only 2 SCTs,
+	// under Chrome's and Apple's CT policies. Longer-lived certificates need 3.
+	maxShortLifetime = 180 * 24 * time.Hour
+
+	// minCTOperators is how many different log operators the SCTs must come from.
+	minCTOperators = 2
+
+	// TLS signature and hash algorithm identifiers used in SCTs, from RFC 5246 section 7.4.1.4.1.
+	tlsHashSHA256 = 4
+	tlsSigRSA     = 1
+	tlsSigECDSA   = 3
+)
+
+// ctLog is one of the logs in a log list.
+type ctLog struct {
+	operator string
+	key      crypto.PublicKey
+
+	// state is the log's state in the log list, such as "usable" or "retired"
+	state string
+
+	// since is when the log entered its state
+	since time.Time
+}
+
+// ctLogs are the logs in a log list, by log ID.
+type ctLogs map[[sha256.Size]byte]ctLog
+
+// logListLog is a log in the JSON log list format used by Chrome and Apple.
+type logListLog struct {
+	LogID []byte `json:"log_id"`
+	Key   []byte `json:"key"`
+	State map[string]struct {
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"state"`
+}
+
+// loadCTLogs reads a log list in the JSON format published by Chrome and Apple.
+// Only the fields needed to check SCTs are parsed.
+func loadCTLogs(path string) (ctLogs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Operators []struct {
+			Name      string       `json:"name"`
+			Logs      []logListLog `json:"logs"`
+			TiledLogs []logListLog `json:"tiled_logs"`
+		} `json:"operators"`
+	}
+
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	logs := make(ctLogs)
+	for _, operator := range list.Operators {
+		for _, l := range slices.Concat(operator.Logs, operator.TiledLogs) {
+			key, err := x509.ParsePKIXPublicKey(l.Key)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key of log %s: %w", base64.StdEncoding.EncodeToString(l.LogID), err)
+			}
+
+			// The log ID is the hash of its key, so SCTs can't be checked against the wrong one
+			id := sha256.Sum256(l.Key)
+			if !bytes.Equal(id[:], l.LogID) {
+				return nil, fmt.Errorf("log %s has an ID that doesn't match its key", base64.StdEncoding.EncodeToString(l.LogID))
+			}
+
+			log := ctLog{operator: operator.Name, key: key}
+			for state, details := range l.State {
+				log.state = state
+				log.since = details.Timestamp
+			}
+
+			logs[id] = log
+		}
+	}
+
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("no logs in %s", path)
+	}
+
+	return logs, nil
+}
+
+// check returns an error if leaf's embedded SCTs wouldn't satisfy Chrome's and Apple's CT policies:
+// 2 valid SCTs, or 3 for a certificate valid for over 180 days, from logs run by at least 2 operators.
+// Each log must be qualified, usable or read-only, or retired after the SCT was issued,
+// with at least one log not retired.
+func (l ctLogs) check(leaf, issuer *x509.Certificate) error {
+	scts, err := embeddedSCTs(leaf)
+	if err != nil {
+		return err
+	}
+
+	// errs are the reasons SCTs didn't count, to explain a failure
+	var errs []error
+	operators := make(map[string]struct{})
+	valid := 0
+	current := false
+
+	for _, s := range scts {
+		logID := base64.StdEncoding.EncodeToString(s.logID[:])
+
+		log, ok := l[s.logID]
+		if !ok {
+			errs = append(errs, fmt.Errorf("SCT from unknown log %s", logID))
+
+			continue
+		}
+
+		err := s.verify(log.key, leaf, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SCT from log %s: %w", logID, err))
+
+			continue
+		}
+
+		switch log.state {
+		case "qualified", "usable", "readonly":
+			current = true
+		case "retired":
+			if !s.time().Before(log.since) {
+				errs = append(errs, fmt.Errorf("SCT from log %s was issued after it was retired", logID))
+
+				continue
+			}
+		default:
+			errs = append(errs, fmt.Errorf("SCT from log %s, which is %q", logID, log.state))
+
+			continue
+		}
+
+		valid++
+		operators[log.operator] = struct{}{}
+	}
+
+	required := 2
+	if leaf.NotAfter.Sub(leaf.NotBefore) > maxShortLifetime {
+		required = 3
+	}
+
+	var failure error
+	switch {
+	case valid < required:
+		failure = fmt.Errorf("%d of %d embedded SCTs are valid, but %d are required", valid, len(scts), required)
+	case len(operators) < minCTOperators:
+		failure = fmt.Errorf("SCTs are from %d log operators, but %d are required", len(operators), minCTOperators)
+	case !current:
+		failure = fmt.Errorf("all SCTs are from retired logs")
+	default:
+		return nil
+	}
+
+	return errors.Join(append([]error{failure}, errs...)...)
+}
+
+// sct is a signed certificate timestamp, from RFC 6962 section 3.2.
+type sct struct {
+	logID      [sha256.Size]byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+// time returns when the log issued the SCT.
+func (s sct) time() time.Time {
+	return time.UnixMilli(int64(s.timestamp)) //nolint:gosec // Timestamps in milliseconds fit in an int64
+}
+
+// verify checks the SCT's signature by key, over the precertificate of leaf, issued by issuer.
+func (s sct) verify(key crypto.PublicKey, leaf, issuer *x509.Certificate) error {
+	tbs, err := removeSCTList(leaf.RawTBSCertificate)
+	if err != nil {
+		return err
+	}
+
+	signed, err := sctSignedData(s.timestamp, issuer, tbs, s.extensions)
+	if err != nil {
+		return err
+	}
+
+	if s.hashAlg != tlsHashSHA256 {
+		return fmt.Errorf("unsupported SCT hash algorithm: %d", s.hashAlg)
+	}
+
+	digest := sha256.Sum256(signed)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if s.sigAlg != tlsSigECDSA || !ecdsa.VerifyASN1(key, digest[:], s.signature) {
+			return fmt.Errorf("invalid SCT signature")
+		}
+	case *rsa.PublicKey:
+		if s.sigAlg != tlsSigRSA {
+			return fmt.Errorf("invalid SCT signature algorithm: %d", s.sigAlg)
+		}
+
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], s.signature)
+		if err != nil {
+			return fmt.Errorf("invalid SCT signature: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported log key type: %T", key)
+	}
+
+	return nil
+}
+
+// sctSignedData returns the data a log signs in an SCT for a precertificate, from RFC 6962 section 3.2.
+func sctSignedData(timestamp uint64, issuer *x509.Certificate, tbs, extensions []byte) ([]byte, error) {
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	var b cryptobyte.Builder
+	b.AddUint8(0) // v1
+	b.AddUint8(0) // certificate_timestamp
+	b.AddUint64(timestamp)
+	b.AddUint16(1) // precert_entry
+	b.AddBytes(issuerKeyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(tbs)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(extensions)
+	})
+
+	return b.Bytes()
+}
+
+// embeddedSCTs returns the SCTs in a certificate's SCT list extension, if it has one.
+func embeddedSCTs(leaf *x509.Certificate) ([]sct, error) {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+
+		var list []byte
+		rest, err := asn1.Unmarshal(ext.Value, &list)
+		if err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("invalid SCT list extension")
+		}
+
+		return parseSCTList(list)
+	}
+
+	return nil, nil
+}
+
+// parseSCTList parses a TLS-encoded SignedCertificateTimestampList, from RFC 6962 section 3.3.
+func parseSCTList(raw []byte) ([]sct, error) {
+	input := cryptobyte.String(raw)
+
+	var list cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&list) || !input.Empty() {
+		return nil, fmt.Errorf("invalid SCT list")
+	}
+
+	var scts []sct
+	for !list.Empty() {
+		var (
+			s                    sct
+			raw, extensions, sig cryptobyte.String
+			version              uint8
+			logID                []byte
+		)
+
+		if !list.ReadUint16LengthPrefixed(&raw) ||
+			!raw.ReadUint8(&version) ||
+			!raw.ReadBytes(&logID, sha256.Size) ||
+			!raw.ReadUint64(&s.timestamp) ||
+			!raw.ReadUint16LengthPrefixed(&extensions) ||
+			!raw.ReadUint8(&s.hashAlg) ||
+			!raw.ReadUint8(&s.sigAlg) ||
+			!raw.ReadUint16LengthPrefixed(&sig) ||
+			!raw.Empty() {
+			return nil, fmt.Errorf("invalid SCT in list")
+		}
+
+		if version != 0 {
+			return nil, fmt.Errorf("unsupported SCT version: %d", version)
+		}
+
+		s.logID = [sha256.Size]byte(logID)
+		s.extensions = extensions
+		s.signature = sig
+		scts = append(scts, s)
+	}
+
+	return scts, nil
+}
+
+// removeSCTList returns a DER TBSCertificate without its SCT list extension.
+// This is the precertificate's TBSCertificate that the SCTs were signed over.
+func removeSCTList(rawTBS []byte) ([]byte, error) {
+	input := cryptobyte.String(rawTBS)
+
+	var tbs cryptobyte.String
+	if !input.ReadASN1(&tbs, cbasn1.SEQUENCE) || !input.Empty() {
+		return nil, fmt.Errorf("invalid TBSCertificate")
+	}
+
+	extensionsTag := cbasn1.Tag(3).Constructed().ContextSpecific()
+
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var field cryptobyte.String
+			var tag cbasn1.Tag
+			if !tbs.ReadAnyASN1Element(&field, &tag) {
+				b.SetError(fmt.Errorf("invalid TBSCertificate field"))
+
+				return
+			}
+
+			if tag != extensionsTag {
+				b.AddBytes(field)
+
+				continue
+			}
+
+			var explicit, extensions cryptobyte.String
+			if !field.ReadASN1(&explicit, extensionsTag) || !explicit.ReadASN1(&extensions, cbasn1.SEQUENCE) {
+				b.SetError(fmt.Errorf("invalid TBSCertificate extensions"))
+
+				return
+			}
+
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var ext, body cryptobyte.String
+						var id asn1.ObjectIdentifier
+						if !extensions.ReadASN1Element(&ext, cbasn1.SEQUENCE) {
+							b.SetError(fmt.Errorf("invalid TBSCertificate extension"))
+
+							return
+						}
+
+						inner := ext
+						if !inner.ReadASN1(&body, cbasn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&id) {
+							b.SetError(fmt.Errorf("invalid TBSCertificate extension"))
+
+							return
+						}
+
+						if !id.Equal(oidSCTList) {
+							b.AddBytes(ext)
+						}
+					}
+				})
+			})
+		}
+	})
+
+	return b.Bytes()
+}
@@ -0,0 +1,249 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testLog is a CT log that can sign SCTs.
+type testLog struct {
+	key      *ecdsa.PrivateKey
+	operator string
+	state    string
+	since    time.Time
+}
+
+// id returns the log's ID, the hash of its public key.
+func (l testLog) id(t *testing.T) [sha256.Size]byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(l.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sha256.Sum256(der)
+}
+
+// sign returns a TLS-encoded SCT from the log for a precertificate.
+func (l testLog) sign(t *testing.T, issuer *x509.Certificate, tbs []byte, timestamp time.Time) []byte {
+	t.Helper()
+
+	ts := uint64(timestamp.UnixMilli()) //nolint:gosec // Test timestamps are positive
+
+	signed, err := sctSignedData(ts, issuer, tbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(signed)
+
+	sig, err := ecdsa.SignASN1(rand.Reader, l.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := l.id(t)
+
+	var b cryptobyte.Builder
+	b.AddUint8(0)
+	b.AddBytes(id[:])
+	b.AddUint64(ts)
+	b.AddUint16LengthPrefixed(func(*cryptobyte.Builder) {})
+	b.AddUint8(tlsHashSHA256)
+	b.AddUint8(tlsSigECDSA)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+
+	return b.BytesOrPanic()
+}
+
+// writeLogList writes a log list with logs in Chrome's JSON format, returning its path.
+func writeLogList(t *testing.T, logs []testLog) string {
+	t.Helper()
+
+	type logJSON struct {
+		LogID []byte                          `json:"log_id"`
+		Key   []byte                          `json:"key"`
+		State map[string]map[string]time.Time `json:"state"`
+	}
+
+	operators := make(map[string][]logJSON)
+	for _, l := range logs {
+		der, err := x509.MarshalPKIXPublicKey(l.key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := l.id(t)
+		operators[l.operator] = append(operators[l.operator], logJSON{
+			LogID: id[:],
+			Key:   der,
+			State: map[string]map[string]time.Time{l.state: {"timestamp": l.since}},
+		})
+	}
+
+	type operatorJSON struct {
+		Name string    `json:"name"`
+		Logs []logJSON `json:"logs"`
+	}
+
+	var list struct {
+		Operators []operatorJSON `json:"operators"`
+	}
+	for name, logs := range operators {
+		list.Operators = append(list.Operators, operatorJSON{Name: name, Logs: logs})
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "log_list.json")
+
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// issueWithSCTs issues a leaf certificate valid for lifetime, with SCTs embedded from each of logs.
+// If corrupt is set, the SCTs are signed over a different precertificate.
+func issueWithSCTs(t *testing.T, ca *testCA, lifetime time.Duration, logs []testLog, corrupt bool) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     []string{"valid.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour).Add(lifetime),
+	}
+
+	precert := func() *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return cert
+	}
+
+	tbs := precert().RawTBSCertificate
+	if corrupt {
+		tbs = append([]byte{}, tbs...)
+		tbs[len(tbs)-1] ^= 1
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, l := range logs {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(l.sign(t, ca.cert, tbs, time.Now().Add(-time.Hour)))
+			})
+		}
+	})
+
+	list, err := asn1.Marshal(b.BytesOrPanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidSCTList, Value: list})
+
+	return precert()
+}
+
+func TestCTLogsCheck(t *testing.T) {
+	t.Parallel()
+
+	newLog := func(operator, state string, since time.Time) testLog {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return testLog{key: key, operator: operator, state: state, since: since}
+	}
+
+	lettuce1 := newLog("Lettuce", "usable", time.Now().Add(-365*24*time.Hour))
+	lettuce2 := newLog("Lettuce", "qualified", time.Now().Add(-24*time.Hour))
+	tomato := newLog("Tomato", "readonly", time.Now().Add(-24*time.Hour))
+	retiredEarly := newLog("Cucumber", "retired", time.Now().Add(-2*time.Hour))
+	retiredLate := newLog("Cucumber", "retired", time.Now())
+	otherRetiredLate := newLog("Radish", "retired", time.Now())
+	rejected := newLog("Onion", "rejected", time.Now().Add(-24*time.Hour))
+	unknown := newLog("Crouton", "usable", time.Now().Add(-24*time.Hour))
+
+	logs, err := loadCTLogs(writeLogList(t, []testLog{lettuce1, lettuce2, tomato, retiredEarly, retiredLate, otherRetiredLate, rejected}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := issueTestCert(t, nil, caTemplate("Salad CT Issuer"))
+
+	const (
+		short = 7 * 24 * time.Hour
+		long  = 200 * 24 * time.Hour
+	)
+
+	for _, tc := range []struct {
+		name     string
+		lifetime time.Duration
+		logs     []testLog
+		corrupt  bool
+		wantErr  bool
+	}{
+		{name: "valid", lifetime: short, logs: []testLog{lettuce1, tomato}},
+		{name: "no-scts", lifetime: short, wantErr: true},
+		{name: "one-operator", lifetime: short, logs: []testLog{lettuce1, lettuce2}, wantErr: true},
+		{name: "long-lived-two", lifetime: long, logs: []testLog{lettuce1, tomato}, wantErr: true},
+		{name: "long-lived-three", lifetime: long, logs: []testLog{lettuce1, lettuce2, tomato}},
+		{name: "unknown-log", lifetime: short, logs: []testLog{lettuce1, unknown}, wantErr: true},
+		{name: "rejected-log", lifetime: short, logs: []testLog{lettuce1, rejected}, wantErr: true},
+		{name: "retired-after-sct", lifetime: short, logs: []testLog{lettuce1, retiredLate}},
+		{name: "retired-before-sct", lifetime: short, logs: []testLog{lettuce1, retiredEarly}, wantErr: true},
+		{name: "all-retired", lifetime: short, logs: []testLog{retiredLate, otherRetiredLate}, wantErr: true},
+		{name: "bad-signature", lifetime: short, logs: []testLog{lettuce1, tomato}, corrupt: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			leaf := issueWithSCTs(t, ca, tc.lifetime, tc.logs, tc.corrupt)
+
+			err := logs.check(leaf, ca.cert)
+			if tc.wantErr && err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -1,21 +1,56 @@
 package acme
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/lego"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/letsencrypt/test-certs-site/certs"
+	"github.com/letsencrypt/test-certs-site/config"
 	"github.com/letsencrypt/test-certs-site/scheduler"
 	"github.com/letsencrypt/test-certs-site/storage"
 )
 
+// maxRejections is how many next certificates in a row can be rejected, before they stop being replaced.
+const maxRejections = 5
+
+// RetryIssuance clears the rejected certificates recorded for each site, so they're replaced again
+// after too many were rejected in a row. It is run from the command line, while the server keeps running.
+func RetryIssuance(cfg *config.Config, store storage.Storage) error {
+	for _, site := range cfg.Sites {
+		for _, keyType := range site.AllKeyTypes() {
+			for _, domain := range []string{site.Domains.Valid, site.Domains.Revoked, site.Domains.Expired} {
+				err := store.ClearRejections(site.CertName(domain, keyType))
+				if err != nil {
+					return fmt.Errorf("%s: %w", domain, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 type issuer struct {
 	checker
 
@@ -23,12 +58,46 @@ type issuer struct {
 	issuerCN string
 	keyType  string
 	profile  string
+	site     config.Site
+
+	// name the certificate is stored as, from the site's CertName
+	name string
+
+	// obtainMu is shared by the issuers of a domain's key types, as their challenges for it would clash
+	obtainMu *sync.Mutex
+
+	// roots to verify the next certificate's chain against. Nil to not verify it.
+	roots *x509.CertPool
+
+	// pin selects which of the CA's chains to use. Nil to use the one picked by issuerCN.
+	pin *chainPin
+
+	// ctLogs to check the next certificate's embedded SCTs against. Nil to not check them.
+	ctLogs ctLogs
+
+	// ctPolicy is what to do with a certificate failing the CT check: alert or enforce
+	ctPolicy string
+
+	// ctFailures counts certificates failing the CT check
+	ctFailures prometheus.Counter
+
+	// checkedSerial is the serial of the last next certificate to pass checkNext, so it's only checked once
+	checkedSerial string
+
+	// alternates are served with the CA's other chains. Their domains are added to the certificate.
+	alternates []config.AlternateChain
 
-	client   *lego.Client
+	// revokeAttempts before giving up on revoking a certificate and issuing a new one
+	revokeAttempts int
+
+	// rejected is how many next certificates in a row couldn't be used
+	rejected prometheus.Gauge
+
+	account  *account
 	logger   *slog.Logger
 	manager  *certs.CertManager
 	schedule *scheduler.Schedule
-	store    *storage.Storage
+	store    storage.Storage
 }
 
 // start is the main entry point for issuing a certificate.
@@ -38,12 +107,21 @@ func (i *issuer) start(ctx context.Context) {
 
 	i.logger.Info("checking certificate")
 
-	curr, err := i.store.ReadCurrent(i.domain)
-	if err != nil {
+	curr, err := i.store.ReadCurrent(i.name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// There's none yet, or it was removed to be replaced, so leave renewAt zero to issue a new cert
+		i.logger.Info("no current certificate")
+	case err != nil:
 		i.logger.Error("reading current certificate", slogErr(err))
 		// If we failed to read, leave renewAt zero, and we'll issue a new cert
-	} else {
-		renewAt = i.checkRenew(ctx, curr.Leaf)
+	default:
+		issuerCert, err := issuerOf(curr)
+		if err != nil {
+			i.logger.Warn("finding current certificate's issuer", slogErr(err))
+		}
+
+		renewAt = i.checkRenew(ctx, curr.Leaf, issuerCert)
 	}
 
 	var nextRun time.Time
@@ -68,26 +146,71 @@ func (i *issuer) start(ctx context.Context) {
 // Return the time to call i.start next
 func (i *issuer) issue(ctx context.Context) (time.Time, error) {
 	// Check if there's a next certificate already in progress
-	next, err := i.store.ReadNext(i.domain)
+	next, err := i.store.ReadNext(i.name)
 	if err != nil {
 		i.logger.Info("couldn't read next certificate so issuing", slogErr(err))
 
+		err = i.abandonRevocation()
+		if err != nil {
+			return time.Time{}, err
+		}
+
 		next, err = i.issueNext()
 		if err != nil {
 			return time.Time{}, err
 		}
 	}
 
-	if len(next.Certificate) <= 1 {
-		return time.Time{}, fmt.Errorf("no issuer certificate: chain length %d", len(next.Certificate))
+	rejections, err := i.readRejections()
+	if err != nil {
+		return time.Time{}, err
 	}
 
-	issuerCert, err := x509.ParseCertificate(next.Certificate[1])
+	if rejections.Serial == serialOf(next) {
+		// The next certificate was rejected already. Make sure it's revoked before replacing it.
+		retryAt, err := i.revokeNext(next)
+		if err != nil || !retryAt.IsZero() {
+			return retryAt, err
+		}
+
+		retryAt = i.retryRejected(rejections)
+		if !retryAt.IsZero() {
+			return retryAt, nil
+		}
+
+		next, err = i.issueNext()
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	// Check the certificate before revoking or waiting on it. A bad one is rejected, and the current one
+	// kept, as the CA is likely to keep issuing the same until the site's config or the CA changes.
+	// It's only checked once, so a certificate failing an alert-only check isn't logged and counted every pass.
+	if serialOf(next) != i.checkedSerial {
+		err = i.checkNext(next)
+		if err != nil {
+			return i.reject(next, rejections, err)
+		}
+
+		i.checkedSerial = serialOf(next)
+	}
+
+	// The next certificate has to be revoked before we can check if it's ready
+	retryAt, err := i.revokeNext(next)
+	if err != nil || !retryAt.IsZero() {
+		return retryAt, err
+	}
+
+	issuerCert, err := issuerOf(next)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("parsing issuer certificate: %w", err)
+		return time.Time{}, err
 	}
 
 	readyTime, err := i.checkReady(ctx, next.Leaf, issuerCert)
+	if errors.Is(err, errUnusable) {
+		return i.reject(next, rejections, err)
+	}
 	if err != nil {
 		// checkReady can return an error if the current "next" cert is broken (eg, expired)
 		// and so we need to issue a new one to start over.
@@ -116,51 +239,463 @@ func (i *issuer) issue(ctx context.Context) (time.Time, error) {
 	return readyTime, nil
 }
 
+// readRejections returns the next certificates rejected in a row, updating the metric.
+func (i *issuer) readRejections() (storage.Rejections, error) {
+	rejections, err := i.store.ReadRejections(i.name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return storage.Rejections{}, fmt.Errorf("reading rejections: %w", err)
+	}
+
+	i.rejected.Set(float64(rejections.Count))
+
+	return rejections, nil
+}
+
+// reject records that the next certificate can't be used, because of reason.
+// It returns when to replace it, backing off as more are rejected in a row.
+func (i *issuer) reject(next tls.Certificate, rejections storage.Rejections, reason error) (time.Time, error) {
+	rejections.Count++
+	rejections.Serial = serialOf(next)
+	rejections.RetryAt = time.Now().Add(revokeBackoff(rejections.Count))
+
+	err := i.store.StoreRejections(i.name, rejections)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not store rejection: %w", err)
+	}
+
+	i.rejected.Set(float64(rejections.Count))
+
+	i.logger.Error("next certificate can't be used; will replace it",
+		slog.Int("rejected", rejections.Count),
+		slog.Time("at", rejections.RetryAt),
+		slogErr(reason))
+
+	return rejections.RetryAt, nil
+}
+
+// retryRejected returns when to replace a rejected next certificate, or a zero time to replace it now.
+// After maxRejections in a row, certificates aren't replaced until the retry-issuance command is run.
+func (i *issuer) retryRejected(rejections storage.Rejections) time.Time {
+	if rejections.Count >= maxRejections {
+		i.logger.Error("too many next certificates were rejected; run retry-issuance to issue another",
+			slog.Int("rejected", rejections.Count))
+
+		return time.Now().Add(time.Hour)
+	}
+
+	if time.Now().Before(rejections.RetryAt) {
+		i.logger.Info("waiting to replace rejected certificate", slog.Time("at", rejections.RetryAt))
+
+		return rejections.RetryAt
+	}
+
+	return time.Time{}
+}
+
+// checkNext checks the next certificate is what was asked for: the right key type, a trusted and pinned chain,
+// and enough SCTs for browsers to accept it.
+func (i *issuer) checkNext(next tls.Certificate) error {
+	keyType, err := publicKeyType(next.Leaf.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyType != i.keyType {
+		return fmt.Errorf("certificate has a %s key, but %s was requested", keyType, i.keyType)
+	}
+
+	if i.roots != nil {
+		err = verifyChain(next, i.domain, i.issuerCN, i.roots)
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.pin != nil {
+		var chainPEM []byte
+		for _, der := range next.Certificate {
+			chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+
+		match, err := i.pin.matches(chainPEM, i.roots)
+		if err != nil {
+			return err
+		}
+		if !match {
+			return errors.New("certificate's chain doesn't include the pinned certificate")
+		}
+	}
+
+	return i.checkSCTs(next)
+}
+
+// checkSCTs checks the next certificate's embedded SCTs satisfy the CT policy, if the site has one.
+// With the alert policy, a certificate failing the check is logged, but still served.
+func (i *issuer) checkSCTs(next tls.Certificate) error {
+	if i.ctLogs == nil {
+		return nil
+	}
+
+	issuerCert, err := issuerOf(next)
+	if err == nil {
+		err = i.ctLogs.check(next.Leaf, issuerCert)
+	}
+	if err == nil {
+		return nil
+	}
+
+	i.ctFailures.Inc()
+
+	if i.ctPolicy == config.CTPolicyEnforce {
+		return fmt.Errorf("certificate doesn't satisfy CT policy: %w", err)
+	}
+
+	i.logger.Error("certificate doesn't satisfy CT policy; serving it anyway", slogErr(err))
+
+	return nil
+}
+
 // issueNext is called to actually issue the next certificate
 func (i *issuer) issueNext() (tls.Certificate, error) {
 	i.logger.Info("issuing new next certificate")
-	key, err := i.store.StoreNextKey(i.domain, i.keyType)
+	client, err := i.account.client(i.site)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not create ACME client: %w", err)
+	}
+
+	key, err := i.store.StoreNextKey(i.name, i.keyType)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("could not store next key: %w", err)
 	}
-	resp, err := i.client.Certificate.Obtain(certificate.ObtainRequest{
+
+	domains := []string{i.domain}
+	for _, alternate := range i.alternates {
+		domains = append(domains, alternate.Domain)
+	}
+
+	if i.shouldRevoke() {
+		// Mark the certificate for revocation before requesting it, so a crash can't leave an issued certificate
+		// without a record of it. issue revokes it, retrying if needed.
+		keyHash, err := spkiHash(key.Public())
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		err = i.store.StorePendingRevocation(i.name, storage.PendingRevocation{KeySPKIHash: keyHash})
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("could not store pending revocation: %w", err)
+		}
+	}
+
+	i.obtainMu.Lock()
+	resp, err := client.Certificate.Obtain(certificate.ObtainRequest{
 		Profile:        i.profile,
-		Domains:        []string{i.domain},
+		Domains:        domains,
 		Bundle:         true,
 		PrivateKey:     key,
 		PreferredChain: i.issuerCN,
 	})
+	i.obtainMu.Unlock()
 	if err != nil {
+		if i.shouldRevoke() {
+			// No certificate was received, so there's none to revoke. One issued despite the error couldn't be
+			// revoked without it anyway.
+			clearErr := i.store.ClearPendingRevocation(i.name)
+			if clearErr != nil {
+				i.logger.Warn("clearing pending revocation", slogErr(clearErr))
+			}
+		}
+
 		return tls.Certificate{}, fmt.Errorf("could not obtain certificate: %w", err)
 	}
 
-	if i.shouldRevoke() {
-		// Revoke with reason keyCompromise so browsers actually process this revocation
-		reasonKeyCompromise := uint(1)
-		err := i.client.Certificate.RevokeWithReason(resp.Certificate, &reasonKeyCompromise)
+	// Store the certificate before anything else can fail, so it can be revoked
+	err = i.store.StoreNextCert(i.name, resp.Certificate)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not store next certificate: %w", err)
+	}
+
+	// The CA's other chains are only needed to pick a pinned one, or to serve alternate domains
+	if i.pin != nil || len(i.alternates) > 0 {
+		err = i.storeChains(resp)
 		if err != nil {
-			// TODO: if we failed to revoke, we should probably retry revoking
-			return tls.Certificate{}, fmt.Errorf("could not revoke certificate: %w", err)
+			// The chain the CA picked is kept. checkNext rejects it if it isn't the pinned chain.
+			i.logger.Warn("storing the CA's other chains", slogErr(err))
 		}
 	}
 
-	err = i.store.StoreNextCert(i.domain, resp.Certificate)
+	i.logger.Info("next certificate issued", slog.String("domain", i.domain))
+
+	return i.store.ReadNext(i.name)
+}
+
+// storeChains replaces the next certificate with its pinned chain, if the site has one,
+// and stores the CA's other chains as alternates.
+func (i *issuer) storeChains(resp *certificate.Resource) error {
+	chains, err := i.fetchChains(resp.CertURL)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not store next certificate: %w", err)
+		return err
 	}
 
-	i.logger.Info("next certificate issued", slog.String("domain", i.domain))
+	chain := resp.Certificate
+	if i.pin != nil {
+		chain, err = i.selectChain(chains)
+		if err != nil {
+			return err
+		}
 
-	return i.store.ReadNext(i.domain)
+		if !bytes.Equal(chain, resp.Certificate) {
+			err = i.store.StoreNextCert(i.name, chain)
+			if err != nil {
+				return fmt.Errorf("could not store pinned chain: %w", err)
+			}
+		}
+	}
+
+	// Every other chain is kept, for the alternate domains to pick from
+	alternates := slices.DeleteFunc(chains, func(c []byte) bool { return bytes.Equal(c, chain) })
+
+	err = i.store.StoreNextAlternates(i.name, alternates)
+	if err != nil {
+		return fmt.Errorf("could not store alternate chains: %w", err)
+	}
+
+	return nil
+}
+
+// fetchChains returns each of the CA's chains for a certificate, as PEM.
+// The chain at certURL is first, followed by its alternates.
+func (i *issuer) fetchChains(certURL string) ([][]byte, error) {
+	core, err := i.account.core()
+	if err != nil {
+		return nil, fmt.Errorf("could not create ACME API client: %w", err)
+	}
+
+	raw, err := core.Certificates.GetAll(certURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not get certificate chains: %w", err)
+	}
+
+	links := slices.Sorted(maps.Keys(raw))
+	links = slices.DeleteFunc(links, func(link string) bool { return link == certURL })
+	links = slices.Insert(links, 0, certURL)
+
+	chains := make([][]byte, 0, len(links))
+	for _, link := range links {
+		chain, ok := raw[link]
+		if ok {
+			chains = append(chains, chain.Cert)
+		}
+	}
+
+	return chains, nil
+}
+
+// selectChain returns the first chain which includes the pinned certificate.
+func (i *issuer) selectChain(chains [][]byte) ([]byte, error) {
+	for idx, chain := range chains {
+		match, err := i.pin.matches(chain, i.roots)
+		if err != nil {
+			return nil, fmt.Errorf("checking chain %d: %w", idx, err)
+		}
+		if match {
+			return chain, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the CA's %d chains include the pinned certificate", len(chains))
+}
+
+// abandonRevocation gives up on the pending revocation of a next certificate that couldn't be read.
+// That's left by a crash between requesting the certificate and storing it. It can't be revoked without
+// the certificate, so its key is logged, for the certificate to be looked up, and the record is cleared.
+func (i *issuer) abandonRevocation() error {
+	pending, err := i.store.ReadPendingRevocation(i.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading pending revocation: %w", err)
+	}
+
+	i.logger.Error("a certificate may have been issued without being stored, so it can't be revoked",
+		slog.String("keySPKIHash", pending.KeySPKIHash))
+
+	err = i.store.ClearPendingRevocation(i.name)
+	if err != nil {
+		return fmt.Errorf("could not clear pending revocation: %w", err)
+	}
+
+	return nil
+}
+
+// revokeNext revokes the next certificate if it has a pending revocation, retrying with backoff.
+// It returns a time to retry at if revocation failed, or a zero time if the certificate is revoked.
+// After revokeAttempts failures, it issues a new next certificate to start over.
+func (i *issuer) revokeNext(next tls.Certificate) (time.Time, error) {
+	pending, err := i.store.ReadPendingRevocation(i.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading pending revocation: %w", err)
+	}
+
+	if time.Now().Before(pending.RetryAt) {
+		i.logger.Info("waiting to retry revocation", slog.Time("at", pending.RetryAt))
+
+		return pending.RetryAt, nil
+	}
+
+	revokeErr := i.revoke(next.Leaf)
+	if revokeErr == nil {
+		i.logger.Info("next certificate revoked")
+
+		return time.Time{}, i.store.ClearPendingRevocation(i.name)
+	}
+
+	pending.Attempts++
+	if pending.Attempts >= i.revokeAttempts {
+		// The unrevoked certificate is abandoned, and will expire on its own.
+		i.logger.Error("giving up revoking next certificate; issuing a new one",
+			slog.Int("attempts", pending.Attempts),
+			slogErr(revokeErr))
+
+		err = i.store.ClearPendingRevocation(i.name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not clear pending revocation: %w", err)
+		}
+
+		_, err = i.issueNext()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		// Return the revocation error, for logging
+		return time.Time{}, fmt.Errorf("could not revoke certificate: %w", revokeErr)
+	}
+
+	pending.RetryAt = time.Now().Add(revokeBackoff(pending.Attempts))
+
+	err = i.store.StorePendingRevocation(i.name, pending)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not store pending revocation: %w", err)
+	}
+
+	i.logger.Warn("revoking next certificate; will retry",
+		slog.Int("attempts", pending.Attempts),
+		slog.Time("at", pending.RetryAt),
+		slogErr(revokeErr))
+
+	return pending.RetryAt, nil
+}
+
+// revoke a certificate with the CA.
+func (i *issuer) revoke(cert *x509.Certificate) error {
+	client, err := i.account.client(i.site)
+	if err != nil {
+		return fmt.Errorf("could not create ACME client: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	})
+
+	// The default reason is keyCompromise, so browsers actually process this revocation
+	_, code := i.site.Revocation()
+	reason := uint(code) //nolint:gosec // Reason codes are small and non-negative
+
+	return client.Certificate.RevokeWithReason(certPEM, &reason)
+}
+
+// issuerOf returns the certificate that issued cert's leaf, from its chain.
+func issuerOf(cert tls.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) <= 1 {
+		return nil, fmt.Errorf("no issuer certificate: chain length %d", len(cert.Certificate))
+	}
+
+	issuerCert, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate: %w", err)
+	}
+
+	return issuerCert, nil
+}
+
+// spkiHash returns the hex SHA-256 hash of a public key's SubjectPublicKeyInfo.
+func spkiHash(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(der)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// publicKeyType returns the configuration key type matching a public key's algorithm and size.
+func publicKeyType(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return config.KeyTypeP256, nil
+		case elliptic.P384():
+			return config.KeyTypeP384, nil
+		default:
+			return "", fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return config.KeyTypeRSA2048, nil
+		case 3072:
+			return config.KeyTypeRSA3072, nil
+		case 4096:
+			return config.KeyTypeRSA4096, nil
+		default:
+			return "", fmt.Errorf("unsupported RSA key size: %d", key.N.BitLen())
+		}
+	case ed25519.PublicKey:
+		return config.KeyTypeEd25519, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+// revokeBackoff returns how long to wait after a failed revocation attempt, or a rejected certificate.
+// It starts at a minute, doubling with each attempt up to an hour.
+func revokeBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for range attempts - 1 {
+		backoff *= 2
+		if backoff >= time.Hour {
+			return time.Hour
+		}
+	}
+
+	return backoff
+}
+
+// serialOf returns the hex serial number of cert's leaf.
+func serialOf(cert tls.Certificate) string {
+	return fmt.Sprintf("%x", cert.Leaf.SerialNumber)
 }
 
 // takeNext checks if the next certificate is ready, and takes it if so
 func (i *issuer) takeNext() error {
 	i.logger.Info("next certificate is ready")
-	_, err := i.store.TakeNext(i.domain)
+	_, err := i.store.TakeNext(i.name)
 	if err != nil {
 		return err
 	}
 
-	return i.manager.LoadCertificate(i.domain)
+	err = i.store.ClearRejections(i.name)
+	if err != nil {
+		return fmt.Errorf("clearing rejections: %w", err)
+	}
+	i.rejected.Set(0)
+
+	return i.manager.LoadCertificate(i.domain, i.keyType)
 }
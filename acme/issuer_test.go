@@ -0,0 +1,197 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/storage"
+)
+
+func TestRevokeBackoff(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: time.Minute},
+		{attempts: 2, expected: 2 * time.Minute},
+		{attempts: 5, expected: 16 * time.Minute},
+		{attempts: 7, expected: time.Hour},
+		{attempts: 100, expected: time.Hour},
+	} {
+		got := revokeBackoff(tc.attempts)
+		if got != tc.expected {
+			t.Errorf("revokeBackoff(%d) = %s, expected %s", tc.attempts, got, tc.expected)
+		}
+	}
+}
+
+func TestPublicKeyType(t *testing.T) {
+	t.Parallel()
+
+	ecdsaKey := func(curve elliptic.Curve) crypto.PublicKey {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return key.Public()
+	}
+
+	rsaKey := func(bits int) crypto.PublicKey {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return key.Public()
+	}
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		key      crypto.PublicKey
+		expected string
+	}{
+		{name: "p256", key: ecdsaKey(elliptic.P256()), expected: config.KeyTypeP256},
+		{name: "p384", key: ecdsaKey(elliptic.P384()), expected: config.KeyTypeP384},
+		{name: "p521", key: ecdsaKey(elliptic.P521())},
+		{name: "rsa2048", key: rsaKey(2048), expected: config.KeyTypeRSA2048},
+		{name: "rsa3072", key: rsaKey(3072), expected: config.KeyTypeRSA3072},
+		{name: "rsa1024", key: rsaKey(1024)},
+		{name: "ed25519", key: edKey, expected: config.KeyTypeEd25519},
+	} {
+		got, err := publicKeyType(tc.key)
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tc.name, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: got key type %s, expected %s", tc.name, got, tc.expected)
+		}
+	}
+}
+
+// TestReject checks rejected certificates are replaced with backoff, until too many are rejected in a row.
+func TestReject(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := issuer{
+		name:     "rejected.salad",
+		logger:   slog.Default(),
+		rejected: prometheus.NewGauge(prometheus.GaugeOpts{Name: "rejected"}),
+		store:    store,
+	}
+
+	var rejections storage.Rejections
+	for count := 1; count <= maxRejections; count++ {
+		next := tls.Certificate{Leaf: &x509.Certificate{SerialNumber: big.NewInt(int64(count))}}
+
+		retryAt, err := i.reject(next, rejections, errUnusable)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rejections, err = i.readRejections()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rejections.Count != count || rejections.Serial != serialOf(next) || !rejections.RetryAt.Equal(retryAt) {
+			t.Fatalf("Expected rejection %d of %s, retrying at %s, got %+v", count, serialOf(next), retryAt, rejections)
+		}
+
+		if got := testutil.ToFloat64(i.rejected); got != float64(count) {
+			t.Fatalf("Expected the metric to be %d, got %f", count, got)
+		}
+
+		if count < maxRejections && !i.retryRejected(rejections).Equal(retryAt) {
+			t.Fatalf("Expected to wait until %s to replace rejection %d", retryAt, count)
+		}
+	}
+
+	// Once the backoff is over, the certificate is replaced, unless too many were rejected
+	rejections.RetryAt = time.Now().Add(-time.Minute)
+	if !i.retryRejected(rejections).After(time.Now()) {
+		t.Fatal("Expected no replacement after too many rejections")
+	}
+
+	rejections.Count = 1
+	if !i.retryRejected(rejections).IsZero() {
+		t.Fatal("Expected a replacement once the backoff is over")
+	}
+}
+
+// TestAbandonRevocation checks a pending revocation left by a crash before the certificate was stored
+// is given up on, so a new next key can be stored.
+func TestAbandonRevocation(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := issuer{
+		name:   "crashed.salad",
+		logger: slog.Default(),
+		store:  store,
+	}
+
+	err = i.abandonRevocation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.StorePendingRevocation(i.name, storage.PendingRevocation{KeySPKIHash: "5a1ad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.StoreNextKey(i.name, config.KeyTypeP256)
+	if !errors.Is(err, storage.ErrPendingRevocation) {
+		t.Fatalf("Expected ErrPendingRevocation, got %v", err)
+	}
+
+	err = i.abandonRevocation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.StoreNextKey(i.name, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
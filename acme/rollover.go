@@ -0,0 +1,268 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	legoAcme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/letsencrypt/test-certs-site/config"
+	"github.com/letsencrypt/test-certs-site/storage"
+)
+
+// RolloverAccountKey replaces the key of the stored ACME account for each directory in use.
+// It is run from the command line, so any running server must be restarted to pick up the new keys.
+func RolloverAccountKey(ctx context.Context, cfg *config.Config, store storage.Storage) error {
+	done := make(map[string]bool)
+	for _, site := range cfg.Sites {
+		directory := cfg.SiteACME(site).Directory
+		if done[directory] {
+			continue
+		}
+		done[directory] = true
+
+		_, err := rolloverKey(ctx, directory, store)
+		if err != nil {
+			return fmt.Errorf("%s: %w", directory, err)
+		}
+	}
+
+	return nil
+}
+
+// rolloverKey replaces the account key, as described in RFC 8555 section 7.3.5.
+// The new key is stored before asking the CA to change it, with the old key kept as PreviousKey
+// until the CA confirms. If that is interrupted, resumeRollover finishes the job.
+func rolloverKey(ctx context.Context, directory string, store storage.Storage) (storage.Account, error) {
+	acct, err := store.ReadACME(directory)
+	if err != nil {
+		return storage.Account{}, fmt.Errorf("reading ACME account: %w", err)
+	}
+
+	if acct.PreviousKey != nil {
+		// An earlier rollover didn't finish, so complete that one instead of starting another.
+		return resumeRollover(ctx, directory, acct, store)
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return storage.Account{}, err
+	}
+
+	acct.PreviousKey = acct.Key
+	acct.Key = newKey
+	acct.KeyCreated = time.Now()
+
+	err = store.StoreACME(directory, acct)
+	if err != nil {
+		return storage.Account{}, fmt.Errorf("storing new account key: %w", err)
+	}
+
+	err = changeKey(ctx, directory, acct)
+	if err != nil {
+		return storage.Account{}, fmt.Errorf("rolling over account key: %w", err)
+	}
+
+	return finishRollover(directory, acct, store)
+}
+
+// resumeRollover finishes a rollover where the CA's response wasn't stored.
+// The CA may or may not have changed the key, so check the new key before trying again.
+func resumeRollover(ctx context.Context, directory string, acct storage.Account, store storage.Storage) (storage.Account, error) {
+	slog.Warn("Resuming incomplete ACME account key rollover",
+		slog.String("directory", directory),
+		slog.String("accountURI", acct.URI))
+
+	err := checkKey(directory, acct)
+	if err != nil {
+		slog.Info("New account key isn't active yet, retrying rollover", slogErr(err))
+
+		err = changeKey(ctx, directory, acct)
+		if err != nil {
+			return storage.Account{}, fmt.Errorf("resuming account key rollover: %w", err)
+		}
+	}
+
+	return finishRollover(directory, acct, store)
+}
+
+// finishRollover stores the account without the previous key, now that the CA is using the new one.
+func finishRollover(directory string, acct storage.Account, store storage.Storage) (storage.Account, error) {
+	acct.PreviousKey = nil
+
+	err := store.StoreACME(directory, acct)
+	if err != nil {
+		return storage.Account{}, fmt.Errorf("storing account after key rollover: %w", err)
+	}
+
+	slog.Info("Rolled over ACME account key",
+		slog.String("directory", directory),
+		slog.String("accountURI", acct.URI))
+
+	return acct, nil
+}
+
+// checkKey returns an error if the CA doesn't recognize acct.Key for the account.
+func checkKey(directory string, acct storage.Account) error {
+	legoCfg := newConfig(&legoUser{key: acct.Key}, directory)
+
+	core, err := api.New(legoCfg.HTTPClient, legoCfg.UserAgent, directory, acct.URI, acct.Key)
+	if err != nil {
+		return err
+	}
+
+	_, err = core.Accounts.Get(acct.URI)
+
+	return err
+}
+
+// keyChangeRequest is the payload of the inner JWS in a key change request.
+type keyChangeRequest struct {
+	Account string          `json:"account"`
+	OldKey  jose.JSONWebKey `json:"oldKey"`
+}
+
+// changeKey asks the CA to replace acct.PreviousKey with acct.Key.
+// lego doesn't support the keyChange endpoint, so this builds the nested JWS itself.
+func changeKey(ctx context.Context, directory string, acct storage.Account) error {
+	legoCfg := newConfig(&legoUser{key: acct.PreviousKey}, directory)
+
+	core, err := api.New(legoCfg.HTTPClient, legoCfg.UserAgent, directory, acct.URI, acct.PreviousKey)
+	if err != nil {
+		return err
+	}
+
+	dir := core.GetDirectory()
+	if dir.KeyChangeURL == "" {
+		return errors.New("ACME server does not support key changes")
+	}
+
+	// The inner JWS is signed by the new key, proving possession of it.
+	innerSigner, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: acct.Key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithHeader("url", dir.KeyChangeURL),
+	)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(keyChangeRequest{
+		Account: acct.URI,
+		OldKey:  jose.JSONWebKey{Key: acct.PreviousKey.Public()},
+	})
+	if err != nil {
+		return err
+	}
+
+	inner, err := innerSigner.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("signing inner key change JWS: %w", err)
+	}
+
+	// Retry once if the nonce was rejected, as the CA may have discarded it.
+	for attempt := 0; ; attempt++ {
+		nonce, err := getNonce(ctx, legoCfg.HTTPClient, legoCfg.UserAgent, dir.NewNonceURL)
+		if err != nil {
+			return err
+		}
+
+		// The outer JWS is an ordinary ACME request, signed by the old key.
+		outerSigner, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: acct.PreviousKey},
+			(&jose.SignerOptions{NonceSource: staticNonce(nonce)}).
+				WithHeader("kid", acct.URI).
+				WithHeader("url", dir.KeyChangeURL),
+		)
+		if err != nil {
+			return err
+		}
+
+		outer, err := outerSigner.Sign([]byte(inner.FullSerialize()))
+		if err != nil {
+			return fmt.Errorf("signing key change JWS: %w", err)
+		}
+
+		err = post(ctx, legoCfg.HTTPClient, legoCfg.UserAgent, dir.KeyChangeURL, outer.FullSerialize())
+
+		var prob *legoAcme.ProblemDetails
+		if attempt == 0 && errors.As(err, &prob) && prob.Type == "urn:ietf:params:acme:error:badNonce" {
+			continue
+		}
+
+		return err
+	}
+}
+
+// post a JWS to an ACME server, returning the problem document if it wasn't successful.
+func post(ctx context.Context, client *http.Client, userAgent, url, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/jose+json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	prob := &legoAcme.ProblemDetails{}
+
+	err = json.NewDecoder(resp.Body).Decode(prob)
+	if err != nil {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+
+	prob.HTTPStatus = resp.StatusCode
+
+	return prob
+}
+
+// getNonce fetches a fresh nonce from the ACME server's newNonce URL.
+func getNonce(ctx context.Context, client *http.Client, userAgent, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching nonce: %w", err)
+	}
+	defer resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("no nonce in newNonce response")
+	}
+
+	return nonce, nil
+}
+
+// staticNonce implements jose.NonceSource, for a nonce fetched ahead of signing.
+type staticNonce string
+
+// Nonce implements jose.NonceSource.
+func (n staticNonce) Nonce() (string, error) {
+	return string(n), nil
+}
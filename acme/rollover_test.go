@@ -0,0 +1,371 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	legoAcme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/letsencrypt/test-certs-site/storage"
+)
+
+func TestPost(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/new-nonce":
+			w.Header().Set("Replay-Nonce", "the-nonce")
+		case "/key-change":
+			if r.Method == http.MethodPost && r.Header.Get("Content-Type") != "application/jose+json" {
+				t.Errorf("Unexpected Content-Type %q", r.Header.Get("Content-Type"))
+			}
+		default:
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce","detail":"stale nonce"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	nonce, err := getNonce(t.Context(), srv.Client(), "test", srv.URL+"/new-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != "the-nonce" {
+		t.Fatalf("Expected nonce from header, got %q", nonce)
+	}
+
+	_, err = getNonce(t.Context(), srv.Client(), "test", srv.URL+"/key-change")
+	if err == nil {
+		t.Fatal("Expected error when no nonce is returned")
+	}
+
+	err = post(t.Context(), srv.Client(), "test", srv.URL+"/key-change", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = post(t.Context(), srv.Client(), "test", srv.URL+"/bad-nonce", "{}")
+
+	var prob *legoAcme.ProblemDetails
+	if !errors.As(err, &prob) {
+		t.Fatalf("Expected problem document, got %v", err)
+	}
+	if prob.Type != "urn:ietf:params:acme:error:badNonce" || prob.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("Unexpected problem %+v", prob)
+	}
+}
+
+// fakeKeyChangeCA is an ACME server with one account, which checks key change requests as RFC 8555 describes.
+type fakeKeyChangeCA struct {
+	t   *testing.T
+	url string
+
+	// mu protects the fields below
+	mu sync.Mutex
+
+	// key is the account's current public key
+	key *ecdsa.PublicKey
+
+	// keyChanges counts the key changes made
+	keyChanges int
+
+	// badNonces is how many more key change requests to reject with a badNonce error
+	badNonces int
+}
+
+// newFakeKeyChangeCA starts a fake CA, whose account has key.
+func newFakeKeyChangeCA(t *testing.T, key *ecdsa.PrivateKey) *fakeKeyChangeCA {
+	t.Helper()
+
+	ca := &fakeKeyChangeCA{t: t, key: &key.PublicKey}
+	ca.url = newTestACMEServer(t, ca).URL
+
+	return ca
+}
+
+func (ca *fakeKeyChangeCA) directory() string {
+	return ca.url + "/directory"
+}
+
+func (ca *fakeKeyChangeCA) accountURI() string {
+	return ca.url + "/account/1"
+}
+
+// accountKey returns the account's current public key and how many times it was changed.
+func (ca *fakeKeyChangeCA) accountKey() (*ecdsa.PublicKey, int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	return ca.key, ca.keyChanges
+}
+
+func (ca *fakeKeyChangeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "crouton")
+
+	switch r.URL.Path {
+	case "/directory":
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.url + "/new-nonce",
+			"newAccount": ca.url + "/new-account",
+			"newOrder":   ca.url + "/new-order",
+			"keyChange":  ca.url + "/key-change",
+		})
+	case "/new-nonce":
+	case "/account/1":
+		_, err := ca.verify(r)
+		if err != nil {
+			writeProblem(w, http.StatusUnauthorized, "unauthorized", err.Error())
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/key-change":
+		ca.keyChange(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks a request is signed by the account's current key, for its URL, returning its payload.
+func (ca *fakeKeyChangeCA) verify(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	outer, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		return nil, err
+	}
+
+	header := outer.Signatures[0].Protected
+	if header.KeyID != ca.accountURI() {
+		return nil, fmt.Errorf("unexpected kid %q", header.KeyID)
+	}
+	if header.ExtraHeaders["url"] != ca.url+r.URL.Path {
+		return nil, fmt.Errorf("unexpected url %v", header.ExtraHeaders["url"])
+	}
+
+	key, _ := ca.accountKey()
+
+	return outer.Verify(key)
+}
+
+// keyChange checks the inner JWS of a key change request, and changes the account's key to the one it's signed by.
+func (ca *fakeKeyChangeCA) keyChange(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	badNonce := ca.badNonces > 0
+	ca.badNonces--
+	ca.mu.Unlock()
+
+	if badNonce {
+		writeProblem(w, http.StatusBadRequest, "badNonce", "stale nonce")
+
+		return
+	}
+
+	payload, err := ca.verify(r)
+	if err != nil {
+		writeProblem(w, http.StatusUnauthorized, "unauthorized", err.Error())
+
+		return
+	}
+
+	inner, err := jose.ParseSigned(string(payload), []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+
+		return
+	}
+
+	header := inner.Signatures[0].Protected
+	if header.JSONWebKey == nil || header.KeyID != "" {
+		ca.t.Errorf("Expected the inner JWS to embed a jwk and no kid, got %+v", header)
+	}
+	if header.ExtraHeaders["url"] != ca.url+"/key-change" {
+		ca.t.Errorf("Expected the inner JWS url to be the keyChange URL, got %v", header.ExtraHeaders["url"])
+	}
+	if header.Nonce != "" {
+		ca.t.Errorf("Expected no nonce in the inner JWS, got %q", header.Nonce)
+	}
+
+	newKey, ok := header.JSONWebKey.Key.(*ecdsa.PublicKey)
+	if !ok {
+		ca.t.Errorf("Expected an ECDSA jwk, got %T", header.JSONWebKey.Key)
+		writeProblem(w, http.StatusBadRequest, "badPublicKey", "not ECDSA")
+
+		return
+	}
+
+	innerPayload, err := inner.Verify(newKey)
+	if err != nil {
+		ca.t.Errorf("Inner JWS isn't signed by its jwk: %v", err)
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+
+		return
+	}
+
+	var req keyChangeRequest
+	err = json.Unmarshal(innerPayload, &req)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if req.Account != ca.accountURI() {
+		ca.t.Errorf("Expected the inner account to be %s, got %s", ca.accountURI(), req.Account)
+	}
+
+	oldKey, ok := req.OldKey.Key.(*ecdsa.PublicKey)
+	if !ok || !oldKey.Equal(ca.key) {
+		ca.t.Errorf("Expected oldKey to be the account's current key, got %v", req.OldKey.Key)
+	}
+
+	ca.key = newKey
+	ca.keyChanges++
+}
+
+func writeProblem(w http.ResponseWriter, status int, problemType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + problemType,
+		"detail": detail,
+	})
+}
+
+func newTestAccountKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+//nolint:paralleltest // The fake CA sets an environment variable
+func TestChangeKey(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		badNonces     int
+		wantChangeErr bool
+	}{
+		{name: "fresh-nonce"},
+		{name: "stale-nonce-retried", badNonces: 1},
+		{name: "stale-nonce-twice", badNonces: 2, wantChangeErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			oldKey, newKey := newTestAccountKey(t), newTestAccountKey(t)
+
+			ca := newFakeKeyChangeCA(t, oldKey)
+			ca.badNonces = tc.badNonces
+
+			err := changeKey(t.Context(), ca.directory(), storage.Account{
+				URI:         ca.accountURI(),
+				Key:         newKey,
+				PreviousKey: oldKey,
+			})
+			if tc.wantChangeErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, changes := ca.accountKey()
+			if !key.Equal(&newKey.PublicKey) || changes != 1 {
+				t.Fatalf("Expected the CA to change to the new key once, got %d changes", changes)
+			}
+		})
+	}
+}
+
+// TestRolloverKey checks a rollover finishes, including after a crash before or after the CA changed the key.
+//
+//nolint:paralleltest // The fake CA sets an environment variable
+func TestRolloverKey(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// interrupted stores the new key alongside the previous one, as a crashed rollover would
+		interrupted bool
+		// caChanged is whether the CA changed the key before the crash
+		caChanged   bool
+		wantChanges int
+	}{
+		{name: "fresh", wantChanges: 1},
+		{name: "crashed-before-change", interrupted: true, wantChanges: 1},
+		{name: "crashed-after-change", interrupted: true, caChanged: true, wantChanges: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			oldKey, newKey := newTestAccountKey(t), newTestAccountKey(t)
+
+			caKey := oldKey
+			if tc.caChanged {
+				caKey = newKey
+			}
+			ca := newFakeKeyChangeCA(t, caKey)
+
+			store, err := storage.NewFiles(t.TempDir(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored := storage.Account{URI: ca.accountURI(), Key: oldKey}
+			if tc.interrupted {
+				stored = storage.Account{URI: ca.accountURI(), Key: newKey, PreviousKey: oldKey}
+			}
+
+			err = store.StoreACME(ca.directory(), stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acct, err := rolloverKey(t.Context(), ca.directory(), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.interrupted {
+				// A fresh rollover generates its own key
+				newKey = acct.Key
+			}
+
+			key, changes := ca.accountKey()
+			if !key.Equal(&newKey.PublicKey) || changes != tc.wantChanges {
+				t.Fatalf("Expected the CA to have the new key after %d changes, got %d", tc.wantChanges, changes)
+			}
+
+			stored, err = store.ReadACME(ca.directory())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !stored.Key.Equal(newKey) || stored.PreviousKey != nil || acct.PreviousKey != nil {
+				t.Fatal("Expected the new key to be stored, without the previous key")
+			}
+		})
+	}
+}
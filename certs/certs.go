@@ -3,84 +3,222 @@ package certs
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/letsencrypt/test-certs-site/config"
 	"github.com/letsencrypt/test-certs-site/storage"
 
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
 	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 )
 
 // CertManager manages the issued certificates
 type CertManager struct {
-	// mu protects certs
+	// mu protects certs and noCRLOutcomes
 	mu sync.Mutex
 
-	// certs is a map of domain to the certificate served
-	certs map[string]*tls.Certificate
+	// certs is a map of domain to the certificates served, by key type
+	certs map[string]map[string]*tls.Certificate
+
+	// noCRLOutcomes is a map of certificate name to the no-CRL policy applied to a revoked domain's current
+	// certificate, if one was
+	noCRLOutcomes map[string]string
 
 	// challengeCerts is a map of domain to TLS-ALPN-01 challenge certs
 	challengeCerts map[string]*tls.Certificate
 
+	// challengeTokens is a map of token to HTTP-01 challenge responses
+	challengeTokens map[string]httpChallenge
+
 	// expired is a map of domain to whether the cert is expected to be expired
 	expired map[string]bool
 
+	// sites is a map of domain to the site it belongs to, for its key types and alternate chains
+	sites map[string]config.Site
+
 	// storage provides persistent storage for certs
-	storage *storage.Storage
+	storage storage.Storage
 }
 
 // New sets up the certificate manager, holding current certs.
-func New(cfg *config.Config, store *storage.Storage) (*CertManager, error) {
+func New(cfg *config.Config, store storage.Storage) (*CertManager, error) {
 	c := &CertManager{
-		certs:          make(map[string]*tls.Certificate),
-		challengeCerts: make(map[string]*tls.Certificate),
-		expired:        make(map[string]bool),
-		storage:        store,
+		certs:           make(map[string]map[string]*tls.Certificate),
+		noCRLOutcomes:   make(map[string]string),
+		challengeCerts:  make(map[string]*tls.Certificate),
+		challengeTokens: make(map[string]httpChallenge),
+		expired:         make(map[string]bool),
+		sites:           make(map[string]config.Site),
+		storage:         store,
 	}
 
-	// Load "Current" certs for each domain, if they exist
 	for _, site := range cfg.Sites {
-		err := c.LoadCertificate(site.Domains.Valid)
-		if err != nil {
-			slog.Info("No current valid certificate", slog.String("domain", site.Domains.Valid), slog.String("error", err.Error()))
+		for _, domain := range []string{site.Domains.Valid, site.Domains.Revoked, site.Domains.Expired} {
+			c.sites[domain] = site
 		}
-		c.expired[site.Domains.Valid] = false
 
-		err = c.LoadCertificate(site.Domains.Revoked)
-		if err != nil {
-			slog.Info("No current revoked certificate", slog.String("domain", site.Domains.Revoked), slog.String("error", err.Error()))
+		// Alternates are loaded along with the valid certificate
+		for _, alternate := range site.AlternateChains {
+			c.sites[alternate.Domain] = site
+			c.expired[alternate.Domain] = false
 		}
+
+		c.expired[site.Domains.Valid] = false
 		c.expired[site.Domains.Revoked] = false
+		c.expired[site.Domains.Expired] = true
+	}
 
-		err = c.LoadCertificate(site.Domains.Expired)
-		if err != nil {
-			slog.Info("No current expired certificate", slog.String("domain", site.Domains.Expired), slog.String("error", err.Error()))
+	// Load "Current" certs for each domain, if they exist
+	for _, site := range cfg.Sites {
+		for _, keyType := range site.AllKeyTypes() {
+			err := c.LoadCertificate(site.Domains.Valid, keyType)
+			if err != nil {
+				slog.Info("No current valid certificate",
+					slog.String("domain", site.Domains.Valid),
+					slog.String("keyType", keyType),
+					slog.String("error", err.Error()))
+			}
+
+			err = c.LoadCertificate(site.Domains.Revoked, keyType)
+			if err != nil {
+				slog.Info("No current revoked certificate",
+					slog.String("domain", site.Domains.Revoked),
+					slog.String("keyType", keyType),
+					slog.String("error", err.Error()))
+			}
+
+			err = c.LoadCertificate(site.Domains.Expired, keyType)
+			if err != nil {
+				slog.Info("No current expired certificate",
+					slog.String("domain", site.Domains.Expired),
+					slog.String("keyType", keyType),
+					slog.String("error", err.Error()))
+			}
 		}
-		c.expired[site.Domains.Expired] = true
 	}
 
 	return c, nil
 }
 
-// LoadCertificate will reload a certificate from storage.
+// LoadCertificate will reload a domain's certificate for a key type from storage.
 // Called at startup and by the ACME client when a new certificate is current.
-func (c *CertManager) LoadCertificate(domain string) error {
-	currCert, err := c.storage.ReadCurrent(domain)
+// Any alternate chains for the domain are loaded too.
+func (c *CertManager) LoadCertificate(domain, keyType string) error {
+	// sites is only written by New, so doesn't need the lock
+	site := c.sites[domain]
+	name := site.CertName(domain, keyType)
+
+	currCert, err := c.storage.ReadCurrent(name)
 	if err != nil {
 		return err
 	}
 
+	var alternates []config.AlternateChain
+	if domain == site.Domains.Valid {
+		alternates = site.AlternateChains
+	}
+
+	var chains []tls.Certificate
+	if len(alternates) > 0 {
+		chains, err = c.storage.ReadCurrentAlternates(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The CA's default chain might be the one wanted on an alternate domain
+	chains = append([]tls.Certificate{currCert}, chains...)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.certs[domain] = &currCert
+	c.set(domain, keyType, &currCert)
+
+	// The no-CRL policy applied to the certificate being served is shown on the revoked domain's pages
+	if domain == site.Domains.Revoked && site.NeedsCRL() && len(currCert.Leaf.CRLDistributionPoints) == 0 {
+		c.noCRLOutcomes[name] = site.NoCRL()
+	} else {
+		delete(c.noCRLOutcomes, name)
+	}
+
+	for _, alternate := range alternates {
+		idx := slices.IndexFunc(chains, func(chain tls.Certificate) bool {
+			return chainIssuerCN(chain) == alternate.IssuerCN
+		})
+		if idx == -1 {
+			slog.Warn("No alternate chain for issuer",
+				slog.String("domain", alternate.Domain),
+				slog.String("keyType", keyType),
+				slog.String("issuerCN", alternate.IssuerCN))
+			c.set(alternate.Domain, keyType, nil)
+
+			continue
+		}
+
+		c.set(alternate.Domain, keyType, &chains[idx])
+	}
 
 	return nil
 }
 
+// chainIssuerCN returns the CN of the issuer of the last certificate in the chain, which is usually the root.
+// It returns an empty string if it can't be parsed.
+func chainIssuerCN(chain tls.Certificate) string {
+	if len(chain.Certificate) == 0 {
+		return ""
+	}
+
+	top, err := x509.ParseCertificate(chain.Certificate[len(chain.Certificate)-1])
+	if err != nil {
+		return ""
+	}
+
+	return top.Issuer.CommonName
+}
+
+// RemoveCertificate stops serving a domain's certificate for a key type, and removes it from storage,
+// so it isn't served again after a restart.
+// Called by the ACME client when the current certificate shouldn't be used.
+func (c *CertManager) RemoveCertificate(domain, keyType string) error {
+	// sites is only written by New, so doesn't need the lock
+	name := c.sites[domain].CertName(domain, keyType)
+
+	c.mu.Lock()
+	c.set(domain, keyType, nil)
+	delete(c.noCRLOutcomes, name)
+	c.mu.Unlock()
+
+	return c.storage.RemoveCurrent(name)
+}
+
+// NoCRLOutcomes returns the no-CRL policy applied to each of a revoked domain's current certificates, by key type.
+// Certificates it wasn't applied to, as they have a CRL distribution point or don't need one, aren't included.
+func (c *CertManager) NoCRLOutcomes(domain string) map[string]string {
+	site := c.sites[domain]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	outcomes := make(map[string]string)
+	for _, keyType := range site.AllKeyTypes() {
+		policy, ok := c.noCRLOutcomes[site.CertName(domain, keyType)]
+		if ok {
+			outcomes[keyType] = policy
+		}
+	}
+
+	return outcomes
+}
+
 // isACME returns true if this ClientHello looks like a TLS-ALPN challenge
 func isACME(info *tls.ClientHelloInfo) bool {
 	return len(info.SupportedProtos) == 1 && info.SupportedProtos[0] == tlsalpn01.ACMETLS1Protocol
@@ -116,8 +254,8 @@ func (c *CertManager) get(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		return challengeCert, nil
 	}
 
-	cert, ok := c.certs[sni]
-	if !ok {
+	cert := c.choose(info)
+	if cert == nil {
 		return nil, fmt.Errorf("no certificate")
 	}
 
@@ -138,6 +276,46 @@ func (c *CertManager) get(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return cert, nil
 }
 
+// choose returns the certificate for the SNI in the first of the site's key types the client supports.
+// If it doesn't support any, the first is used anyway, so the handshake fails as the client would expect.
+// Caller should hold mu.
+func (c *CertManager) choose(info *tls.ClientHelloInfo) *tls.Certificate { //nolint:funcorder
+	certs := c.certs[info.ServerName]
+
+	var first *tls.Certificate
+	for _, keyType := range c.sites[info.ServerName].AllKeyTypes() {
+		cert, ok := certs[keyType]
+		if !ok {
+			continue
+		}
+
+		if info.SupportsCertificate(cert) == nil {
+			return cert
+		}
+
+		if first == nil {
+			first = cert
+		}
+	}
+
+	return first
+}
+
+// set the certificate for a domain and key type, or remove it if cert is nil. Caller should hold mu.
+func (c *CertManager) set(domain, keyType string, cert *tls.Certificate) { //nolint:funcorder
+	if cert == nil {
+		delete(c.certs[domain], keyType)
+
+		return
+	}
+
+	if c.certs[domain] == nil {
+		c.certs[domain] = make(map[string]*tls.Certificate)
+	}
+
+	c.certs[domain][keyType] = cert
+}
+
 // Present is a method from the lego challenge.Provider interface.
 // It creates and stores a TLS-ALPN-01 challenge certificate.
 func (c *CertManager) Present(domain, _, keyAuth string) error {
@@ -164,3 +342,73 @@ func (c *CertManager) CleanUp(domain, _, _ string) error {
 
 	return nil
 }
+
+// httpChallenge is a pending HTTP-01 challenge response.
+type httpChallenge struct {
+	domain  string
+	keyAuth string
+}
+
+// http01Provider implements the lego challenge.Provider interface for HTTP-01.
+// Challenges are stored in the CertManager, and served by its ServeHTTP method.
+type http01Provider struct {
+	manager *CertManager
+}
+
+// HTTP01Provider returns a lego challenge.Provider for HTTP-01 challenges.
+func (c *CertManager) HTTP01Provider() challenge.Provider {
+	return http01Provider{manager: c}
+}
+
+// Present stores the key authorization to be served for the challenge token.
+func (p http01Provider) Present(domain, token, keyAuth string) error {
+	p.manager.mu.Lock()
+	defer p.manager.mu.Unlock()
+
+	p.manager.challengeTokens[token] = httpChallenge{
+		domain:  domain,
+		keyAuth: keyAuth,
+	}
+
+	return nil
+}
+
+// CleanUp removes the challenge token once it is no longer needed.
+func (p http01Provider) CleanUp(_, token, _ string) error {
+	p.manager.mu.Lock()
+	defer p.manager.mu.Unlock()
+
+	delete(p.manager.challengeTokens, token)
+
+	return nil
+}
+
+// ServeHTTP answers HTTP-01 challenge requests on the plain HTTP listener.
+func (c *CertManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, http01.ChallengePath(""))
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	c.mu.Lock()
+	chall, found := c.challengeTokens[token]
+	c.mu.Unlock()
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// No port in the Host header
+		host = r.Host
+	}
+
+	if !found || host != chall.domain {
+		slog.Warn("unknown HTTP-01 challenge", slog.String("host", r.Host), slog.String("path", r.URL.Path))
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(chall.keyAuth))
+}
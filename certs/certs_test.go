@@ -1,10 +1,19 @@
 package certs
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"slices"
 	"sync"
 	"testing"
@@ -55,14 +64,19 @@ func TestExpiredHandling(t *testing.T) {
 
 			cm := CertManager{
 				mu: sync.Mutex{},
-				certs: map[string]*tls.Certificate{
+				certs: map[string]map[string]*tls.Certificate{
 					tc.name: {
-						Leaf: &x509.Certificate{
-							NotAfter: tc.NotAfter,
-							DNSNames: []string{tc.name},
+						config.KeyTypeP256: {
+							Leaf: &x509.Certificate{
+								NotAfter: tc.NotAfter,
+								DNSNames: []string{tc.name},
+							},
 						},
 					},
 				},
+				sites: map[string]config.Site{
+					tc.name: {KeyType: config.KeyTypeP256},
+				},
 				expired: map[string]bool{
 					tc.name: tc.shouldBeExpired,
 				},
@@ -96,7 +110,7 @@ func TestExpiredHandling(t *testing.T) {
 func TestACME(t *testing.T) {
 	t.Parallel()
 
-	store, err := storage.New(t.TempDir())
+	store, err := storage.NewFiles(t.TempDir(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -148,3 +162,404 @@ func TestACME(t *testing.T) {
 		t.Fatal("Expected error after cleanup, got none")
 	}
 }
+
+func TestHTTP01(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := New(&config.Config{
+		Sites: nil,
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDomain := "mytestsite.com"
+	provider := manager.HTTP01Provider()
+
+	err = provider.Present(testDomain, "the-token", "the-token.the-thumbprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		host string
+		path string
+		code int
+		body string
+	}{
+		{
+			name: "valid",
+			host: testDomain,
+			path: "/.well-known/acme-challenge/the-token",
+			code: http.StatusOK,
+			body: "the-token.the-thumbprint",
+		},
+		{
+			name: "with-port",
+			host: testDomain + ":80",
+			path: "/.well-known/acme-challenge/the-token",
+			code: http.StatusOK,
+			body: "the-token.the-thumbprint",
+		},
+		{
+			name: "wrong-host",
+			host: "othersite.com",
+			path: "/.well-known/acme-challenge/the-token",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "wrong-token",
+			host: testDomain,
+			path: "/.well-known/acme-challenge/other-token",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "wrong-path",
+			host: testDomain,
+			path: "/",
+			code: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			request.Host = tc.host
+			record := httptest.NewRecorder()
+
+			manager.ServeHTTP(record, request)
+
+			if record.Code != tc.code {
+				t.Fatalf("got %d from handler, expected %d", record.Code, tc.code)
+			}
+
+			if tc.body != "" && record.Body.String() != tc.body {
+				t.Fatalf("got body %q, expected %q", record.Body.String(), tc.body)
+			}
+		})
+	}
+}
+
+func TestHTTP01CleanUp(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := New(&config.Config{
+		Sites: nil,
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := manager.HTTP01Provider()
+
+	err = provider.Present("mytestsite.com", "the-token", "the-key-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.CleanUp("mytestsite.com", "the-token", "the-key-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/the-token", nil)
+	request.Host = "mytestsite.com"
+	record := httptest.NewRecorder()
+
+	manager.ServeHTTP(record, request)
+
+	if record.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after cleanup, got %d", record.Code)
+	}
+}
+
+// TestAlternateChains checks alternate domains are served the chain ending in their issuer.
+func TestAlternateChains(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const domain = "valid.salad"
+
+	key, err := store.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	// create a certificate, returning it as PEM
+	create := func(template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) []byte {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent = template
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	ca := func(cn string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: cn},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+
+	// The intermediate is cross-signed by two roots, so the same leaf has a chain to each
+	rootAKey, rootBKey, intermediateKey := newKey(), newKey(), newKey()
+	rootA, rootB := ca("Root A"), ca("Root B")
+	create(rootA, nil, rootAKey.Public(), rootAKey)
+	create(rootB, nil, rootBKey.Public(), rootBKey)
+
+	intermediateA := create(ca("Intermediate"), rootA, intermediateKey.Public(), rootAKey)
+	intermediateB := create(ca("Intermediate"), rootB, intermediateKey.Public(), rootBKey)
+	leaf := create(&x509.Certificate{DNSNames: []string{domain, "cross.salad"}}, ca("Intermediate"), key.Public(), intermediateKey)
+
+	err = store.StoreNextCert(domain, slices.Concat(leaf, intermediateA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.StoreNextAlternates(domain, [][]byte{slices.Concat(leaf, intermediateB)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := New(&config.Config{
+		Sites: []config.Site{{
+			IssuerCN: "Root A",
+			KeyType:  config.KeyTypeP256,
+			AlternateChains: []config.AlternateChain{
+				{Domain: "cross.salad", IssuerCN: "Root B"},
+				{Domain: "missing.salad", IssuerCN: "Root C"},
+			},
+			Domains: config.Domains{Valid: domain},
+		}},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sni, issuerCN := range map[string]string{domain: "Root A", "cross.salad": "Root B"} {
+		cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		top, err := x509.ParseCertificate(cert.Certificate[len(cert.Certificate)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if top.Issuer.CommonName != issuerCN {
+			t.Errorf("Expected %s chain to end in %s, got %s", sni, issuerCN, top.Issuer.CommonName)
+		}
+	}
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "missing.salad"})
+	if err == nil {
+		t.Fatal("Expected no certificate without a matching chain")
+	}
+}
+
+// TestKeyTypes checks clients are served the first of a site's key types they support.
+func TestKeyTypes(t *testing.T) {
+	t.Parallel()
+
+	const domain = "dual.salad"
+
+	selfSigned := func(key crypto.Signer) *tls.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			DNSNames:     []string{domain},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := CertManager{
+		certs: map[string]map[string]*tls.Certificate{
+			domain: {
+				config.KeyTypeP256:    selfSigned(ecdsaKey),
+				config.KeyTypeRSA2048: selfSigned(rsaKey),
+			},
+		},
+		sites: map[string]config.Site{
+			domain: {KeyTypes: []string{config.KeyTypeP256, config.KeyTypeRSA2048}},
+		},
+		expired: map[string]bool{domain: false},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		hello    *tls.ClientHelloInfo
+		expected string
+	}{
+		{
+			name: "modern",
+			hello: &tls.ClientHelloInfo{
+				ServerName:        domain,
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+				CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+			},
+			expected: config.KeyTypeP256,
+		},
+		{
+			name: "rsa-only",
+			hello: &tls.ClientHelloInfo{
+				ServerName:        domain,
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.CurveP256},
+				SupportedPoints:   []uint8{0},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			},
+			expected: config.KeyTypeRSA2048,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cert, err := cm.GetCertificate(tc.hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cert != cm.certs[domain][tc.expected] {
+				t.Fatalf("Expected the %s certificate", tc.expected)
+			}
+		})
+	}
+}
+
+// TestNoCRLOutcomes checks the no-CRL policy is recorded for each revoked certificate served without a CRL.
+func TestNoCRLOutcomes(t *testing.T) {
+	t.Parallel()
+
+	store, err := storage.NewFiles(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := config.Site{
+		KeyTypes:    []string{config.KeyTypeP256, config.KeyTypeP384},
+		NoCRLPolicy: config.NoCRLRequireOCSP,
+		Domains:     config.Domains{Revoked: "revoked.salad"},
+	}
+
+	// Only the P-256 certificate is missing a CRL
+	for keyType, crls := range map[string][]string{
+		config.KeyTypeP256: nil,
+		config.KeyTypeP384: {"http://crl.salad/1.crl"},
+	} {
+		name := site.CertName(site.Domains.Revoked, keyType)
+
+		key, err := store.StoreNextKey(name, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			DNSNames:              []string{site.Domains.Revoked},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			CRLDistributionPoints: crls,
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.StoreNextCert(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.TakeNext(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager, err := New(&config.Config{Sites: []config.Site{site}}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := manager.NoCRLOutcomes(site.Domains.Revoked)
+	if len(outcomes) != 1 || outcomes[config.KeyTypeP256] != config.NoCRLRequireOCSP {
+		t.Fatalf("Expected only the p256 certificate to have the require-ocsp outcome, got %v", outcomes)
+	}
+
+	// A certificate that isn't served has no outcome
+	err = manager.RemoveCertificate(site.Domains.Revoked, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes = manager.NoCRLOutcomes(site.Domains.Revoked)
+	if len(outcomes) != 0 {
+		t.Fatalf("Expected no outcomes once the certificate is removed, got %v", outcomes)
+	}
+}
@@ -2,20 +2,129 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 )
 
 const (
 	// KeyTypeP256 is one of the valid key types in configuration.
 	KeyTypeP256 = "p256"
 
+	// KeyTypeP384 is one of the valid key types in configuration.
+	KeyTypeP384 = "p384"
+
 	// KeyTypeRSA2048 is one of the valid key types in configuration.
 	KeyTypeRSA2048 = "rsa2048"
+
+	// KeyTypeRSA3072 is one of the valid key types in configuration.
+	KeyTypeRSA3072 = "rsa3072"
+
+	// KeyTypeRSA4096 is one of the valid key types in configuration.
+	KeyTypeRSA4096 = "rsa4096"
+
+	// KeyTypeEd25519 is one of the valid key types in configuration. Few CAs issue for Ed25519 keys.
+	KeyTypeEd25519 = "ed25519"
+)
+
+const (
+	// ChallengeTLSALPN01 is the default challenge type, answered on ListenAddr.
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	// ChallengeHTTP01 is a challenge type answered on HTTPListenAddr.
+	ChallengeHTTP01 = "http-01"
+
+	// ChallengeDNS01 is a challenge type answered by publishing TXT records, configured in Site.DNS01.
+	ChallengeDNS01 = "dns-01"
+)
+
+const (
+	// TSIGAlgorithmHMACSHA1 signs DNS-01 updates with HMAC-SHA1.
+	TSIGAlgorithmHMACSHA1 = "hmac-sha1"
+
+	// TSIGAlgorithmHMACSHA224 signs DNS-01 updates with HMAC-SHA224.
+	TSIGAlgorithmHMACSHA224 = "hmac-sha224"
+
+	// TSIGAlgorithmHMACSHA256 is the default, signing DNS-01 updates with HMAC-SHA256.
+	TSIGAlgorithmHMACSHA256 = "hmac-sha256"
+
+	// TSIGAlgorithmHMACSHA384 signs DNS-01 updates with HMAC-SHA384.
+	TSIGAlgorithmHMACSHA384 = "hmac-sha384"
+
+	// TSIGAlgorithmHMACSHA512 signs DNS-01 updates with HMAC-SHA512.
+	TSIGAlgorithmHMACSHA512 = "hmac-sha512"
+)
+
+const (
+	// RevocationCheckCRL is the default revocation check policy, requiring the CRL to list the certificate.
+	RevocationCheckCRL = "crl"
+
+	// RevocationCheckOCSP requires the OCSP responder to report the certificate revoked.
+	RevocationCheckOCSP = "ocsp"
+
+	// RevocationCheckEither requires the CRL or OCSP responder to report the certificate revoked.
+	RevocationCheckEither = "either"
+
+	// RevocationCheckBoth requires the CRL and OCSP responder to report the certificate revoked.
+	RevocationCheckBoth = "both"
+)
+
+const (
+	// NoCRLRefuse is the default policy for revoked certificates without a CRL distribution point.
+	// They are rejected, and replaced after a backoff.
+	NoCRLRefuse = "refuse"
+
+	// NoCRLAssumeRevoked uses revoked certificates without a CRL distribution point, without checking.
+	NoCRLAssumeRevoked = "assume-revoked"
+
+	// NoCRLRequireOCSP checks OCSP instead, for revoked certificates without a CRL distribution point.
+	NoCRLRequireOCSP = "require-ocsp"
 )
 
+const (
+	// StorageFiles is the default storage backend, keeping files in DataDir.
+	StorageFiles = "files"
+
+	// StorageVault keeps keys and certificates in a HashiCorp Vault KV version 2 secrets engine.
+	StorageVault = "vault"
+
+	// StorageKubernetes keeps keys and certificates in Kubernetes Secrets.
+	StorageKubernetes = "kubernetes"
+
+	// StorageS3 keeps keys and certificates in an S3-compatible object storage bucket.
+	StorageS3 = "s3"
+)
+
+const (
+	// CTPolicyAlert logs and counts certificates whose embedded SCTs wouldn't satisfy browsers' CT policies,
+	// but still serves them.
+	CTPolicyAlert = "alert"
+
+	// CTPolicyEnforce replaces certificates whose embedded SCTs wouldn't satisfy browsers' CT policies.
+	CTPolicyEnforce = "enforce"
+)
+
+const (
+	// RevocationReasonKeyCompromise is the default revocation reason, as browsers process it.
+	RevocationReasonKeyCompromise = "keyCompromise"
+)
+
+// RevocationReasons maps the valid revocation reasons in configuration to RFC 5280 reason codes.
+var RevocationReasons = map[string]int{
+	"unspecified":                 0,
+	RevocationReasonKeyCompromise: 1,
+	"affiliationChanged":          3,
+	"superseded":                  4,
+	"cessationOfOperation":        5,
+}
+
 // Load a configuration file from cfgPath.
 func Load(cfgPath string) (*Config, error) {
 	cfgBytes, err := os.ReadFile(cfgPath) //nolint:gosec // Reading arbitrary config file is expected
@@ -39,19 +148,98 @@ func Load(cfgPath string) (*Config, error) {
 }
 
 // validate the loaded configuration.
-// This checks domains are unique, key types are valid, and that an issuer CN is set.
+// This checks domains are unique, key and challenge types are valid, and that an issuer CN is set.
 func validate(cfg *Config) error {
 	domains := make(map[string]struct{}, 0)
 	var errs []error
 	for i, site := range cfg.Sites {
-		switch site.KeyType {
-		case KeyTypeP256, KeyTypeRSA2048:
-			// Valid key types
+		if site.KeyType != "" && len(site.KeyTypes) > 0 {
+			errs = append(errs, fmt.Errorf("site %d can't set both a key type and key types", i))
+		}
+
+		keyTypes := make(map[string]struct{})
+		for _, keyType := range site.AllKeyTypes() {
+			switch keyType {
+			case KeyTypeP256, KeyTypeP384, KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096, KeyTypeEd25519:
+				// Valid key types
+			default:
+				errs = append(errs, fmt.Errorf("site %d unsupported key type: %s", i, keyType))
+			}
+
+			_, seen := keyTypes[keyType]
+			if seen {
+				errs = append(errs, fmt.Errorf("site %d duplicate key type: %s", i, keyType))
+			}
+			keyTypes[keyType] = struct{}{}
+		}
+
+		switch site.ChallengeType {
+		case "", ChallengeTLSALPN01:
+			// TLS-ALPN-01 is answered by the main listener, so needs no extra configuration
+		case ChallengeHTTP01:
+			if cfg.HTTPListenAddr == "" {
+				errs = append(errs, fmt.Errorf("site %d uses %s but no HTTP listen address is set", i, site.ChallengeType))
+			}
+		case ChallengeDNS01:
+			if site.DNS01.Nameserver == "" || site.DNS01.Zone == "" {
+				errs = append(errs, fmt.Errorf("site %d uses %s but has no nameserver or zone", i, site.ChallengeType))
+			}
+			if site.DNS01.TSIGKey == "" || site.DNS01.TSIGSecret == "" {
+				errs = append(errs, fmt.Errorf("site %d uses %s but has no TSIG key", i, site.ChallengeType))
+			}
+
+			switch site.DNS01.Algorithm() {
+			case TSIGAlgorithmHMACSHA1, TSIGAlgorithmHMACSHA224, TSIGAlgorithmHMACSHA256,
+				TSIGAlgorithmHMACSHA384, TSIGAlgorithmHMACSHA512:
+				// Valid TSIG algorithms
+			default:
+				errs = append(errs, fmt.Errorf("site %d unsupported TSIG algorithm: %s", i, site.DNS01.TSIGAlgorithm))
+			}
 		default:
-			errs = append(errs, fmt.Errorf("site %d unsupported key type: %s", i, site.KeyType))
+			errs = append(errs, fmt.Errorf("site %d unsupported challenge type: %s", i, site.ChallengeType))
 		}
 
-		for _, d := range []string{site.Domains.Valid, site.Domains.Revoked, site.Domains.Expired} {
+		switch site.RevocationCheck {
+		case "", RevocationCheckCRL, RevocationCheckOCSP, RevocationCheckEither, RevocationCheckBoth:
+			// Valid revocation check policies
+		default:
+			errs = append(errs, fmt.Errorf("site %d unsupported revocation check: %s", i, site.RevocationCheck))
+		}
+
+		switch site.NoCRLPolicy {
+		case "", NoCRLRefuse, NoCRLAssumeRevoked, NoCRLRequireOCSP:
+			// Valid no-CRL policies
+		default:
+			errs = append(errs, fmt.Errorf("site %d unsupported no-CRL policy: %s", i, site.NoCRLPolicy))
+		}
+
+		switch site.CTPolicy {
+		case "":
+			// CT isn't checked
+		case CTPolicyAlert, CTPolicyEnforce:
+			if cfg.CTLogList == "" {
+				errs = append(errs, fmt.Errorf("site %d has a CT policy but no CT log list is set", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("site %d unsupported CT policy: %s", i, site.CTPolicy))
+		}
+
+		if site.RevocationReason != "" {
+			_, ok := RevocationReasons[site.RevocationReason]
+			if !ok {
+				errs = append(errs, fmt.Errorf("site %d unsupported revocation reason: %s", i, site.RevocationReason))
+			}
+		}
+
+		siteDomains := []string{site.Domains.Valid, site.Domains.Revoked, site.Domains.Expired}
+		for j, alternate := range site.AlternateChains {
+			if alternate.Domain == "" || alternate.IssuerCN == "" {
+				errs = append(errs, fmt.Errorf("site %d alternate chain %d needs a domain and issuer CN", i, j))
+			}
+			siteDomains = append(siteDomains, alternate.Domain)
+		}
+
+		for _, d := range siteDomains {
 			_, seen := domains[d]
 			if seen {
 				errs = append(errs, fmt.Errorf("site %d duplicate domain: %s", i, d))
@@ -62,17 +250,109 @@ func validate(cfg *Config) error {
 		if site.IssuerCN == "" {
 			errs = append(errs, fmt.Errorf("site %d missing issuer CN", i))
 		}
+
+		if site.ChainSPKIHash != "" && site.ChainCertFile != "" {
+			errs = append(errs, fmt.Errorf("site %d can't pin both a chain SPKI hash and certificate file", i))
+		}
+
+		if site.ChainSPKIHash != "" {
+			hash, err := hex.DecodeString(site.ChainSPKIHash)
+			if err != nil || len(hash) != sha256.Size {
+				errs = append(errs, fmt.Errorf("site %d invalid chain SPKI hash: %s", i, site.ChainSPKIHash))
+			}
+		}
+	}
+
+	switch cfg.Storage.Backend {
+	case "", StorageFiles, StorageKubernetes:
+		// Files only need DataDir, and Kubernetes defaults to the pod's own namespace
+	case StorageVault:
+		if cfg.Storage.Vault.Address == "" || cfg.Storage.Vault.Path == "" {
+			errs = append(errs, fmt.Errorf("vault storage needs an address and path"))
+		}
+	case StorageS3:
+		if cfg.Storage.S3.Bucket == "" {
+			errs = append(errs, fmt.Errorf("s3 storage needs a bucket"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported storage backend: %s", cfg.Storage.Backend))
+	}
+
+	if cfg.Storage.EncryptionKeyFile != "" && !slices.Contains([]string{"", StorageFiles, StorageS3}, cfg.Storage.Backend) {
+		errs = append(errs, fmt.Errorf("encrypting private keys isn't supported by the %q storage backend", cfg.Storage.Backend))
 	}
 
-	if cfg.ACME.Directory == "" {
+	if cfg.RevokeAttempts < 0 {
+		errs = append(errs, fmt.Errorf("revoke attempts can't be negative"))
+	}
+
+	// The global ACME configuration is only needed if a site doesn't have its own
+	usesGlobal := len(cfg.Sites) == 0
+	directories := make(map[string]ACME)
+	for i, site := range cfg.Sites {
+		if site.ACME == nil {
+			usesGlobal = true
+
+			continue
+		}
+
+		for _, err := range validateACME(*site.ACME) {
+			errs = append(errs, fmt.Errorf("site %d %w", i, err))
+		}
+
+		// Sites sharing a directory share an account, so they must agree on its settings
+		other, seen := directories[site.ACME.Directory]
+		if seen && !reflect.DeepEqual(other, *site.ACME) {
+			errs = append(errs, fmt.Errorf("site %d has different ACME settings to another site using %s", i, site.ACME.Directory))
+		}
+		directories[site.ACME.Directory] = *site.ACME
+	}
+
+	if usesGlobal {
+		errs = append(errs, validateACME(cfg.ACME)...)
+
+		other, seen := directories[cfg.ACME.Directory]
+		if seen && !reflect.DeepEqual(other, cfg.ACME) {
+			errs = append(errs, fmt.Errorf("global ACME settings differ from a site using %s", cfg.ACME.Directory))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateACME checks an ACME configuration, either the global one or a site's.
+func validateACME(acme ACME) []error {
+	var errs []error
+
+	if acme.Directory == "" {
 		errs = append(errs, fmt.Errorf("acme directory required"))
 	}
 
-	if !cfg.ACME.TermsOfServiceAgreed {
+	if !acme.TermsOfServiceAgreed {
 		errs = append(errs, fmt.Errorf("review and agree to terms of service"))
 	}
 
-	return errors.Join(errs...)
+	for _, contact := range acme.Contacts {
+		u, err := url.Parse(contact)
+		if err != nil || u.Scheme == "" || (u.Opaque == "" && u.Host == "") {
+			errs = append(errs, fmt.Errorf("contact %q should be a URL, eg mailto:admin@example.org", contact))
+		}
+	}
+
+	hasHMAC := acme.EABHMACKey != "" || acme.EABHMACKeyFile != ""
+	if acme.EABHMACKey != "" && acme.EABHMACKeyFile != "" {
+		errs = append(errs, fmt.Errorf("only one of EAB HMAC key and EAB HMAC key file can be set"))
+	}
+
+	if acme.EABKeyID != "" && !hasHMAC {
+		errs = append(errs, fmt.Errorf("EAB key ID requires an EAB HMAC key"))
+	}
+
+	if acme.EABKeyID == "" && hasHMAC {
+		errs = append(errs, fmt.Errorf("EAB HMAC key requires an EAB key ID"))
+	}
+
+	return errs
 }
 
 // Config is the structure of the JSON configuration file.
@@ -80,6 +360,10 @@ type Config struct {
 	// ListenAddr for the demo site to listen on. Eg, ":443".
 	ListenAddr string
 
+	// HTTPListenAddr for the plain HTTP listener serving HTTP-01 challenges. Eg, ":80".
+	// Optional, but required if any site uses the http-01 challenge type.
+	HTTPListenAddr string
+
 	// DebugAddr is the listen address for metrics and pprof
 	DebugAddr string
 
@@ -91,7 +375,11 @@ type Config struct {
 	// It should exist and be writable.
 	DataDir string
 
-	// ACME client configuration.
+	// Storage selects where keys, certificates and ACME accounts are kept.
+	// Optional, defaults to files in DataDir.
+	Storage Storage
+
+	// ACME client configuration, for sites which don't set their own.
 	ACME ACME
 
 	// HTMLTemplate overrides the default HTML webpage
@@ -108,24 +396,246 @@ type Config struct {
 
 	// CRLCheckInterval is the re-checking interval for CRLs
 	CRLCheckInterval Duration
+
+	// RevocationMonitorInterval is how often to check the revoked sites' current certificates are still revoked.
+	// A certificate that isn't is replaced. Optional, defaults to 1h. Negative to disable.
+	RevocationMonitorInterval Duration
+
+	// RevokeAttempts is how many times to try revoking a certificate before issuing a new one instead.
+	// Optional, defaults to 10.
+	RevokeAttempts int
+
+	// CTLogList is a CT log list file, in the JSON format published by Chrome or Apple.
+	// Embedded SCTs are verified against its logs. Optional, but required if any site sets a CTPolicy.
+	CTLogList string
+}
+
+// SiteACME returns the ACME configuration a site uses: its own if set, or else the global one.
+func (c *Config) SiteACME(site Site) ACME {
+	if site.ACME != nil {
+		return *site.ACME
+	}
+
+	return c.ACME
 }
 
 // Site configures a particular site.
 type Site struct {
 	// IssuerCN that the certificate chain must end in.
+	// It's passed to the CA as the preferred chain, and shown on the site.
 	IssuerCN string
 
-	// KeyType to use for this site. Should be "p256" or "rsa2048".
+	// ChainSPKIHash pins the chain to use to one with this root or intermediate, by the hex SHA-256 hash of
+	// its SubjectPublicKeyInfo. The CA's alternate chains are searched for it, as cross-signed roots can share a CN.
+	// A root that isn't served is only found if it's in TrustedRoots.
+	// Optional.
+	ChainSPKIHash string
+
+	// ChainCertFile pins the chain like ChainSPKIHash, to the root or intermediate in this PEM file.
+	// Optional.
+	ChainCertFile string
+
+	// TrustedRoots is a PEM file of root certificates. If set, the chain of each new certificate
+	// must verify to one of them named IssuerCN, or it won't be served.
+	// Optional, as without it only the CA's preference for IssuerCN is relied on.
+	TrustedRoots string
+
+	// KeyType to use for this site. Should be "p256", "p384", "rsa2048", "rsa3072", "rsa4096" or "ed25519".
 	KeyType string
 
+	// KeyTypes replaces KeyType, to issue a certificate for each of several key types, stored by domain and key type.
+	// Each client is served the first one it supports, so they should be in order of preference.
+	// Optional.
+	KeyTypes []string
+
 	// Profile selects the ACME profile to use for this certificate.
 	// Optional.
 	Profile string
 
+	// ChallengeType selects how this site is validated: "tls-alpn-01", "http-01" or "dns-01".
+	// Optional, defaults to "tls-alpn-01".
+	ChallengeType string
+
+	// DNS01 configures the DNS server to update for the dns-01 challenge type.
+	DNS01 DNS01
+
+	// RevocationReason to revoke the revoked certificate with: "unspecified", "keyCompromise",
+	// "affiliationChanged", "superseded" or "cessationOfOperation".
+	// Optional, defaults to "keyCompromise". The CA may restrict which reasons can be used.
+	RevocationReason string
+
+	// RevocationCheck selects which sources must report the revoked certificate as revoked before it's used:
+	// "crl", "ocsp", "either" or "both". OCSP uses the certificate's AIA OCSP URL.
+	// Optional, defaults to "crl".
+	RevocationCheck string
+
+	// NoCRLPolicy decides what to do with a revoked certificate that has no CRL distribution point,
+	// when RevocationCheck needs a CRL ("crl" or "both"): "refuse", "assume-revoked" or "require-ocsp".
+	// Optional, defaults to "refuse".
+	NoCRLPolicy string
+
+	// CTPolicy checks the embedded SCTs of new certificates against CTLogList, before they're served:
+	// "alert" to log and count certificates that browsers would reject, or "enforce" to replace them.
+	// Optional, as by default SCTs aren't checked.
+	CTPolicy string
+
+	// AlternateChains serve the valid certificate with the CA's other chains, each on its own domain.
+	// Optional.
+	AlternateChains []AlternateChain
+
+	// ACME replaces the global ACME configuration for this site, to use a different CA.
+	// Optional. Sites using the same directory share an account, so must have the same settings.
+	ACME *ACME
+
 	// Domain names to use.
 	Domains Domains
 }
 
+// AllKeyTypes returns the site's key types, in order of preference.
+func (s Site) AllKeyTypes() []string {
+	if len(s.KeyTypes) > 0 {
+		return s.KeyTypes
+	}
+
+	return []string{s.KeyType}
+}
+
+// CertName returns the name that the certificate for one of the site's domains and key types is stored as.
+// A site with a single KeyType uses the domain alone. With KeyTypes, each is stored by domain and key type,
+// so reordering them can't serve a certificate as the wrong key type.
+func (s Site) CertName(domain, keyType string) string {
+	if len(s.KeyTypes) == 0 {
+		return domain
+	}
+
+	return domain + "+" + keyType
+}
+
+// Revocation returns the name and RFC 5280 reason code of the site's revocation reason.
+func (s Site) Revocation() (string, int) {
+	reason := s.RevocationReason
+	if reason == "" {
+		reason = RevocationReasonKeyCompromise
+	}
+
+	return reason, RevocationReasons[reason]
+}
+
+// NoCRL returns the site's no-CRL policy, or the default if it isn't set.
+func (s Site) NoCRL() string {
+	if s.NoCRLPolicy == "" {
+		return NoCRLRefuse
+	}
+
+	return s.NoCRLPolicy
+}
+
+// NeedsCRL returns true if the site's revocation check can't be satisfied without a CRL,
+// so its no-CRL policy applies to revoked certificates without a CRL distribution point.
+// OCSP alone satisfies the "ocsp" and "either" checks.
+func (s Site) NeedsCRL() bool {
+	return s.RevocationCheck != RevocationCheckOCSP && s.RevocationCheck != RevocationCheckEither
+}
+
+// AlternateChain is one of the CA's alternate chains for a site's valid certificate, such as a cross-signed one.
+type AlternateChain struct {
+	// Domain to serve the chain on. It's added to the valid certificate.
+	Domain string
+
+	// IssuerCN that the alternate chain ends in.
+	IssuerCN string
+}
+
+// Storage configures the storage backend.
+type Storage struct {
+	// Backend to use: "files", to keep files in DataDir, "vault", "kubernetes" or "s3".
+	// Optional, defaults to "files".
+	Backend string
+
+	// EncryptionKeyFile contains a base64 encoded 256-bit key-encryption key, to encrypt private keys with
+	// before they're stored. Only supported by the "files" and "s3" backends. The key can be set in the
+	// TEST_CERTS_SITE_ENCRYPTION_KEY environment variable instead. Optional, keys are stored unencrypted if neither is set.
+	EncryptionKeyFile string
+
+	// Vault configures the "vault" backend.
+	Vault Vault
+
+	// Kubernetes configures the "kubernetes" backend.
+	Kubernetes Kubernetes
+
+	// S3 configures the "s3" backend.
+	S3 S3
+}
+
+// Vault configures storage in a HashiCorp Vault KV version 2 secrets engine.
+type Vault struct {
+	// Address of the Vault server. Eg, "https://vault.example.org:8200".
+	Address string
+
+	// Mount path of the KV secrets engine.
+	// Optional, defaults to "secret".
+	Mount string
+
+	// Path under the mount to keep secrets in. Eg, "test-certs-site".
+	Path string
+
+	// TokenFile contains the Vault token to authenticate with. It's read for each request.
+	// Optional, as the VAULT_TOKEN environment variable is used if it isn't set.
+	TokenFile string
+
+	// Namespace to use, for Vault Enterprise.
+	// Optional.
+	Namespace string
+
+	// CACertFile is a PEM file of CA certificates to verify the Vault server with.
+	// Optional, defaults to the system's trust store.
+	CACertFile string
+}
+
+// Kubernetes configures storage in Kubernetes Secrets.
+// Every setting defaults to the pod's service account, when running in a cluster.
+type Kubernetes struct {
+	// Namespace to keep Secrets in.
+	// Optional, defaults to the pod's namespace.
+	Namespace string
+
+	// Prefix for the names of Secrets.
+	// Optional, defaults to "test-certs-site".
+	Prefix string
+
+	// APIServer is the URL of the Kubernetes API server.
+	// Optional, defaults to the in-cluster address.
+	APIServer string
+
+	// TokenFile contains the bearer token to authenticate with. It's read for each request, as it's rotated.
+	// Optional, defaults to the service account token.
+	TokenFile string
+
+	// CACertFile is a PEM file of CA certificates to verify the API server with.
+	// Optional, defaults to the service account's CA.
+	CACertFile string
+}
+
+// S3 configures storage in an S3-compatible object storage bucket.
+// Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type S3 struct {
+	// Bucket to keep objects in.
+	Bucket string
+
+	// Prefix of the keys of objects. Eg, "test-certs-site/".
+	// Optional.
+	Prefix string
+
+	// Region of the bucket, which requests are signed for.
+	// Optional, defaults to "us-east-1".
+	Region string
+
+	// Endpoint of an S3-compatible service. Eg, "https://minio.example.org:9000".
+	// Requests to it have the bucket in the path, rather than the host name.
+	// Optional, defaults to AWS S3 in Region.
+	Endpoint string
+}
+
 // Domains that this demo site will serve.
 type Domains struct {
 	Valid   string
@@ -133,11 +643,60 @@ type Domains struct {
 	Revoked string
 }
 
-// ACME client configuration, shared between all sites.
+// DNS01 configures publishing DNS-01 challenge records with RFC 2136 dynamic updates.
+type DNS01 struct {
+	// Nameserver that accepts updates for Zone, as host:port. Eg, "ns1.example.org:53".
+	Nameserver string
+
+	// Zone containing the _acme-challenge records. Eg, "example.org".
+	Zone string
+
+	// TSIGKey is the name of the key used to sign updates.
+	TSIGKey string
+
+	// TSIGSecret is the base64-encoded TSIG secret.
+	TSIGSecret string
+
+	// TSIGAlgorithm used to sign updates: "hmac-sha1", "hmac-sha224", "hmac-sha256", "hmac-sha384" or
+	// "hmac-sha512", in any case and with or without a trailing dot.
+	// Optional, defaults to "hmac-sha256".
+	TSIGAlgorithm string
+}
+
+// Algorithm returns the TSIG algorithm in lower case without a trailing dot, or the default if it isn't set.
+func (d DNS01) Algorithm() string {
+	alg := strings.TrimSuffix(strings.ToLower(d.TSIGAlgorithm), ".")
+	if alg == "" {
+		return TSIGAlgorithmHMACSHA256
+	}
+
+	return alg
+}
+
+// ACME client configuration. One account is used for each directory.
 type ACME struct {
 	// Directory URL.
 	Directory string
 
 	// TermsOfServicesAgreed should be set after reviewing the CA's TOS.
 	TermsOfServiceAgreed bool
+
+	// Contacts for the ACME account, as URLs. Eg, "mailto:admin@example.org".
+	// Optional. When set, the account is updated at startup if its contacts differ.
+	Contacts []string
+
+	// MaxAccountKeyAge rolls over the account key once it is older than this.
+	// Optional. Accounts stored before key ages were recorded are rolled over right away.
+	MaxAccountKeyAge Duration
+
+	// EABKeyID is the External Account Binding key ID, for CAs which require EAB.
+	// Optional. Only used when registering a new account.
+	EABKeyID string
+
+	// EABHMACKey is the base64url-encoded External Account Binding HMAC key.
+	// Optional. Set either this or EABHMACKeyFile with EABKeyID.
+	EABHMACKey string
+
+	// EABHMACKeyFile is a path to a file containing the EABHMACKey, to keep it out of the config.
+	EABHMACKeyFile string
 }
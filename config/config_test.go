@@ -16,11 +16,21 @@ func TestLoadConfig(t *testing.T) {
 		ListenAddr: "localhost:8443",
 		DebugAddr:  "localhost:9876",
 
+		HTTPListenAddr: "localhost:8080",
+
 		Sites: []config.Site{
 			{
-				IssuerCN: "minica root ca 5345e6",
-				KeyType:  "p256",
-				Profile:  "shortlived",
+				IssuerCN:      "minica root ca 5345e6",
+				KeyType:       "p256",
+				Profile:       "shortlived",
+				ChallengeType: "dns-01",
+				DNS01: config.DNS01{
+					Nameserver:    "localhost:8053",
+					Zone:          "localhost",
+					TSIGKey:       "test-certs-site",
+					TSIGSecret:    "c2FsYWQgZHJlc3Npbmc=",
+					TSIGAlgorithm: "HMAC-SHA512.",
+				},
 				Domains: config.Domains{
 					Valid:   "minica-valid.localhost",
 					Expired: "minica-expired.localhost",
@@ -28,20 +38,60 @@ func TestLoadConfig(t *testing.T) {
 				},
 			},
 			{
-				IssuerCN: "Interesting Salad Root Greens",
-				KeyType:  "rsa2048",
-				Profile:  "tlsserver",
+				IssuerCN:         "Interesting Salad Root Greens",
+				TrustedRoots:     "/etc/salad/roots.pem",
+				ChainSPKIHash:    "f1b1e09e2b7f0d3b7b1a6c1c6e5d6e9b7a8c1b2d3e4f5a6b7c8d9e0f1a2b3c4d",
+				KeyTypes:         []string{"p256", "rsa2048"},
+				Profile:          "tlsserver",
+				ChallengeType:    "http-01",
+				RevocationReason: "superseded",
+				RevocationCheck:  "both",
+				NoCRLPolicy:      "require-ocsp",
+				CTPolicy:         "enforce",
+				AlternateChains: []config.AlternateChain{{
+					Domain:   "cross-signed.isrg.example.org",
+					IssuerCN: "Old Salad Root",
+				}},
 				Domains: config.Domains{
 					Valid:   "valid.isrg.example.org",
 					Expired: "expired.isrg.example.org",
 					Revoked: "revoked.isrg.example.org",
 				},
 			},
+			{
+				IssuerCN: "Staging Salad Root Greens",
+				KeyType:  "ed25519",
+				ACME: &config.ACME{
+					Directory:            "https://localhost:14001/dir",
+					TermsOfServiceAgreed: true,
+					Contacts:             []string{"mailto:staging@example.org"},
+				},
+				Domains: config.Domains{
+					Valid:   "valid.staging.example.org",
+					Expired: "expired.staging.example.org",
+					Revoked: "revoked.staging.example.org",
+				},
+			},
 		},
 
 		ACME: config.ACME{
 			Directory:            "https://localhost:14000/dir",
 			TermsOfServiceAgreed: true,
+			Contacts:             []string{"mailto:admin@example.org", "mailto:oncall@example.org"},
+			MaxAccountKeyAge:     config.Duration(365 * 24 * time.Hour),
+			EABKeyID:             "kid-1",
+			EABHMACKeyFile:       "testdata/eab.key",
+		},
+
+		Storage: config.Storage{
+			Backend: "vault",
+			Vault: config.Vault{
+				Address:    "https://vault.example.org:8200",
+				Mount:      "kv",
+				Path:       "test-certs-site",
+				TokenFile:  "testdata/vault.token",
+				CACertFile: "testdata/vault-ca.pem",
+			},
 		},
 
 		DataDir:          "testdata/data_dir/",
@@ -49,6 +99,10 @@ func TestLoadConfig(t *testing.T) {
 		TextTemplate:     "testdata/template.txt",
 		RevokeDelay:      config.Duration(time.Hour),
 		CRLCheckInterval: config.Duration(time.Minute),
+		RevokeAttempts:   5,
+
+		RevocationMonitorInterval: config.Duration(30 * time.Minute),
+		CTLogList:                 "testdata/log_list.json",
 	}
 
 	_, err := config.Load("non-existant.json")
@@ -81,9 +135,74 @@ func TestInvalidConfig(t *testing.T) {
 		"site 1 duplicate domain: valid.salad",
 		"site 0 unsupported key type: 3des",
 		"site 1 unsupported key type: ",
+		"site 0 unsupported challenge type: carrier-pigeon-01",
+		"site 0 unsupported revocation reason: certificateHold",
+		"site 0 unsupported revocation check: carrier-pigeon",
+		"site 0 unsupported no-CRL policy: shrug",
+		"site 0 unsupported CT policy: whenever",
+		"site 1 has a CT policy but no CT log list is set",
+		"site 1 uses http-01 but no HTTP listen address is set",
+		"site 2 uses dns-01 but has no nameserver or zone",
+		"site 2 uses dns-01 but has no TSIG key",
+		"site 2 unsupported TSIG algorithm: hmac-md5",
+		"site 1 invalid chain SPKI hash: 0123abcd",
+		"site 2 can't pin both a chain SPKI hash and certificate file",
+		"site 2 alternate chain 0 needs a domain and issuer CN",
+		"site 2 duplicate domain: valid.salad",
+		"site 3 can't set both a key type and key types",
+		"site 3 duplicate key type: p384",
+		"only one of EAB HMAC key and EAB HMAC key file can be set",
+		"EAB HMAC key requires an EAB key ID",
+		`contact "admin@example.org" should be a URL, eg mailto:admin@example.org`,
+		"revoke attempts can't be negative",
+		"unsupported storage backend: floppy",
+		`encrypting private keys isn't supported by the "floppy" storage backend`,
+		"site 3 review and agree to terms of service",
+		"site 4 has different ACME settings to another site using https://staging.salad/dir",
 	} {
 		if !strings.Contains(errStr, expected) {
 			t.Errorf("got error %q, want error containing %q", errStr, expected)
 		}
 	}
 }
+
+func TestCertName(t *testing.T) {
+	t.Parallel()
+
+	single := config.Site{KeyType: "p256"}
+
+	if name := single.CertName("valid.salad", "p256"); name != "valid.salad" {
+		t.Errorf("Expected a single key type to be stored by domain, got %s", name)
+	}
+
+	// Reordering key types doesn't change where each is stored
+	for _, site := range []config.Site{
+		{KeyTypes: []string{"p256", "rsa2048"}},
+		{KeyTypes: []string{"rsa2048", "p256"}},
+	} {
+		for _, keyType := range site.KeyTypes {
+			if name := site.CertName("valid.salad", keyType); name != "valid.salad+"+keyType {
+				t.Errorf("Expected %v to store %s by domain and key type, got %s", site.KeyTypes, keyType, name)
+			}
+		}
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		reason       string
+		expectedName string
+		expectedCode int
+	}{
+		{reason: "", expectedName: "keyCompromise", expectedCode: 1},
+		{reason: "unspecified", expectedName: "unspecified", expectedCode: 0},
+		{reason: "cessationOfOperation", expectedName: "cessationOfOperation", expectedCode: 5},
+	} {
+		name, code := config.Site{RevocationReason: tc.reason}.Revocation()
+		if name != tc.expectedName || code != tc.expectedCode {
+			t.Errorf("Revocation() for %q = %s, %d, expected %s, %d", tc.reason, name, code, tc.expectedName, tc.expectedCode)
+		}
+	}
+}
@@ -28,6 +28,16 @@ func run(args []string) error {
 
 	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
 	cfgPath := fs.String("config", "config.json", "path to json config file")
+	fs.Usage = func() {
+		out := fs.Output()
+		_, _ = fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", args[0])
+		_, _ = fmt.Fprintf(out, "With no command, runs the server. Commands:\n")
+		_, _ = fmt.Fprintf(out, "  rollover-account-key: replace the ACME account key, then exit\n")
+		_, _ = fmt.Fprintf(out, "  retry-issuance: replace certificates again after too many were rejected, then exit\n")
+		_, _ = fmt.Fprintf(out, "  encrypt-data-dir: encrypt private keys in dataDir written before encryption was enabled, then exit\n\n")
+		_, _ = fmt.Fprintf(out, "Flags:\n")
+		fs.PrintDefaults()
+	}
 
 	err := fs.Parse(args[1:])
 	if err != nil {
@@ -47,11 +57,15 @@ func run(args []string) error {
 		logLevel.Set(slog.LevelDebug)
 	}
 
-	store, err := storage.New(cfg.DataDir)
+	store, err := storage.New(cfg)
 	if err != nil {
 		return fmt.Errorf("creating storage: %w", err)
 	}
 
+	if fs.NArg() > 0 {
+		return runCommand(context.Background(), fs.Args(), cfg, store)
+	}
+
 	certManager, err := certs.New(cfg, store)
 	if err != nil {
 		return err
@@ -65,12 +79,38 @@ func run(args []string) error {
 
 	schedule := scheduler.New(ctx)
 
-	err = acme.New(cfg, store, schedule, certManager)
+	profiles, err := acme.New(ctx, cfg, store, schedule, certManager, registry)
 	if err != nil {
 		return err
 	}
 
-	return server.Run(ctx, cfg, registry, certManager.GetCertificate)
+	return server.Run(ctx, cfg, registry, profiles, certManager.GetCertificate, certManager.NoCRLOutcomes, certManager)
+}
+
+// runCommand runs a one-off command instead of the server.
+func runCommand(ctx context.Context, args []string, cfg *config.Config, store storage.Storage) error {
+	switch args[0] {
+	case "rollover-account-key":
+		return acme.RolloverAccountKey(ctx, cfg, store)
+	case "retry-issuance":
+		return acme.RetryIssuance(cfg, store)
+	case "encrypt-data-dir":
+		files, ok := store.(*storage.Files)
+		if !ok {
+			return fmt.Errorf("encrypt-data-dir needs the %s storage backend", config.StorageFiles)
+		}
+
+		encrypted, err := files.EncryptExisting()
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", cfg.DataDir, err)
+		}
+
+		slog.Info("Encrypted data directory", slog.String("dir", cfg.DataDir), slog.Int("files", encrypted))
+
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
 }
 
 func main() {
@@ -0,0 +1,117 @@
+// Package rfc2136 fulfills ACME DNS-01 challenges by publishing TXT records
+// with RFC 2136 dynamic updates, signed with TSIG.
+package rfc2136
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+const (
+	// ttl of the challenge TXT records. They are short-lived, so keep caching to a minimum.
+	ttl = 60
+
+	// fudge is the permitted clock skew, in seconds, for TSIG signatures. 300 is recommended by RFC 8945.
+	fudge = 300
+
+	// timeout for each update sent to the nameserver.
+	timeout = 10 * time.Second
+)
+
+// algorithms are the supported TSIG algorithms.
+var algorithms = map[string]string{
+	config.TSIGAlgorithmHMACSHA1:   dns.HmacSHA1,
+	config.TSIGAlgorithmHMACSHA224: dns.HmacSHA224,
+	config.TSIGAlgorithmHMACSHA256: dns.HmacSHA256,
+	config.TSIGAlgorithmHMACSHA384: dns.HmacSHA384,
+	config.TSIGAlgorithmHMACSHA512: dns.HmacSHA512,
+}
+
+// Provider implements the lego challenge.Provider interface for DNS-01 challenges.
+type Provider struct {
+	nameserver string
+	zone       string
+	keyName    string
+	algorithm  string
+	client     *dns.Client
+}
+
+// New creates a Provider sending updates to the configured nameserver.
+func New(cfg config.DNS01) (*Provider, error) {
+	algorithm, ok := algorithms[cfg.Algorithm()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm: %s", cfg.TSIGAlgorithm)
+	}
+
+	keyName := dns.CanonicalName(cfg.TSIGKey)
+
+	return &Provider{
+		nameserver: cfg.Nameserver,
+		zone:       dns.CanonicalName(cfg.Zone),
+		keyName:    keyName,
+		algorithm:  algorithm,
+		client: &dns.Client{
+			Timeout:    timeout,
+			TsigSecret: map[string]string{keyName: cfg.TSIGSecret},
+		},
+	}, nil
+}
+
+// Present adds the TXT record for a DNS-01 challenge.
+func (p *Provider) Present(domain, _, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+
+	return p.update(info.EffectiveFQDN, info.Value, false)
+}
+
+// CleanUp removes the TXT record once the challenge is complete.
+func (p *Provider) CleanUp(domain, _, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+
+	return p.update(info.EffectiveFQDN, info.Value, true)
+}
+
+// update sends a signed dynamic update, inserting or removing a single TXT record.
+func (p *Provider) update(fqdn, value string, remove bool) error {
+	fqdn = dns.CanonicalName(fqdn)
+	if !dns.IsSubDomain(p.zone, fqdn) {
+		return fmt.Errorf("challenge record %s is not in zone %s", fqdn, p.zone)
+	}
+
+	rrs := []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Txt: []string{value},
+	}}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(p.zone)
+
+	if remove {
+		msg.Remove(rrs)
+	} else {
+		msg.Insert(rrs)
+	}
+
+	msg.SetTsig(p.keyName, p.algorithm, fudge, time.Now().Unix())
+
+	resp, _, err := p.client.Exchange(msg, p.nameserver)
+	if err != nil {
+		return fmt.Errorf("sending DNS update to %s: %w", p.nameserver, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update for %s rejected by %s: %s", fqdn, p.nameserver, dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
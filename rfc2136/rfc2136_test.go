@@ -0,0 +1,193 @@
+package rfc2136
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+const (
+	testKey    = "test-certs-site."
+	testSecret = "c2FsYWQgZHJlc3Npbmc="
+)
+
+// testZone is a minimal authoritative server which applies TXT record updates.
+type testZone struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch {
+	case r.Opcode != dns.OpcodeUpdate:
+		m.Rcode = dns.RcodeNotImplemented
+	case r.IsTsig() == nil || w.TsigStatus() != nil:
+		m.Rcode = dns.RcodeNotAuth
+	default:
+		z.apply(r.Ns)
+		m.SetTsig(testKey, dns.HmacSHA256, fudge, time.Now().Unix())
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+func (z *testZone) apply(rrs []dns.RR) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		name := txt.Hdr.Name
+		switch txt.Hdr.Class {
+		case dns.ClassINET:
+			z.records[name] = append(z.records[name], txt.Txt...)
+		case dns.ClassNONE:
+			z.records[name] = slices.DeleteFunc(z.records[name], func(v string) bool {
+				return slices.Contains(txt.Txt, v)
+			})
+		}
+	}
+}
+
+func (z *testZone) get(name string) []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	return slices.Clone(z.records[name])
+}
+
+// startServer runs a testZone on a local UDP port, returning the zone and its address.
+func startServer(t *testing.T) (*testZone, string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone := &testZone{records: make(map[string][]string)}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    zone,
+		TsigSecret: map[string]string{testKey: testSecret},
+
+		// The default accept function rejects UPDATE messages
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+
+	return zone, pc.LocalAddr().String()
+}
+
+func TestPresentCleanUp(t *testing.T) {
+	t.Parallel()
+
+	zone, addr := startServer(t)
+
+	provider, err := New(config.DNS01{
+		Nameserver: addr,
+		Zone:       "example.org",
+		TSIGKey:    "test-certs-site",
+		TSIGSecret: testSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const domain = "valid.example.org"
+	info := dns01.GetChallengeInfo(domain, "the-key-auth")
+
+	err = provider.Present(domain, "unused-token", "the-key-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := zone.get(info.EffectiveFQDN)
+	if !slices.Equal(got, []string{info.Value}) {
+		t.Fatalf("Expected TXT record %q at %s, got %q", info.Value, info.EffectiveFQDN, got)
+	}
+
+	err = provider.CleanUp(domain, "unused-token", "the-key-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = zone.get(info.EffectiveFQDN)
+	if len(got) != 0 {
+		t.Fatalf("Expected TXT record to be removed, got %q", got)
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	t.Parallel()
+
+	_, addr := startServer(t)
+
+	for _, tc := range []struct {
+		name   string
+		domain string
+		cfg    config.DNS01
+	}{
+		{
+			name:   "wrong-secret",
+			domain: "valid.example.org",
+			cfg: config.DNS01{
+				Nameserver: addr,
+				Zone:       "example.org",
+				TSIGKey:    "test-certs-site",
+				TSIGSecret: "d3Jvbmcgc2VjcmV0",
+			},
+		},
+		{
+			name:   "wrong-zone",
+			domain: "valid.example.com",
+			cfg: config.DNS01{
+				Nameserver: addr,
+				Zone:       "example.org",
+				TSIGKey:    "test-certs-site",
+				TSIGSecret: testSecret,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			provider, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = provider.Present(tc.domain, "unused-token", "the-key-auth")
+			if err == nil {
+				t.Fatal("Expected update to fail")
+			}
+		})
+	}
+
+	_, err := New(config.DNS01{TSIGAlgorithm: "hmac-md5"})
+	if err == nil {
+		t.Fatal("Expected unsupported algorithm to fail")
+	}
+}
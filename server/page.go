@@ -26,28 +26,66 @@ type handler struct {
 	htmlTemplate *template.Template
 	textTemplate *template.Template
 	domains      map[string]info
+	noCRL        NoCRLOutcomeFunc
 }
 
 type info struct {
 	IssuerCN string
 	State    string
+
+	// Profile is the ACME profile the certificate was issued with, if the site sets one,
+	// and ProfileDescription is the CA's description of it
+	Profile            string
+	ProfileDescription string
+
+	// RevocationReason is only set for revoked sites
+	RevocationReason string
+
+	// NoCRLPolicies are the no-CRL policies applied to a revoked site's certificates without a CRL
+	// distribution point, by key type
+	NoCRLPolicies map[string]string
 }
 
-func newHandler(cfg *config.Config, registry prometheus.Registerer) (http.HandlerFunc, error) {
+func newHandler(
+	cfg *config.Config,
+	profiles map[string]string,
+	noCRL NoCRLOutcomeFunc,
+	registry prometheus.Registerer,
+) (http.HandlerFunc, error) {
 	domains := make(map[string]info)
 
 	for _, site := range cfg.Sites {
+		revocationReason, _ := site.Revocation()
+		profileDescription := profiles[site.Domains.Valid]
+
 		domains[site.Domains.Valid] = info{
-			IssuerCN: site.IssuerCN,
-			State:    "valid",
+			IssuerCN:           site.IssuerCN,
+			State:              "valid",
+			Profile:            site.Profile,
+			ProfileDescription: profileDescription,
 		}
 		domains[site.Domains.Revoked] = info{
-			IssuerCN: site.IssuerCN,
-			State:    "revoked",
+			IssuerCN:           site.IssuerCN,
+			State:              "revoked",
+			Profile:            site.Profile,
+			ProfileDescription: profileDescription,
+			RevocationReason:   revocationReason,
 		}
 		domains[site.Domains.Expired] = info{
-			IssuerCN: site.IssuerCN,
-			State:    "expired",
+			IssuerCN:           site.IssuerCN,
+			State:              "expired",
+			Profile:            site.Profile,
+			ProfileDescription: profileDescription,
+		}
+
+		// Alternate chains serve the valid certificate, showing the path through a different issuer
+		for _, alternate := range site.AlternateChains {
+			domains[alternate.Domain] = info{
+				IssuerCN:           alternate.IssuerCN,
+				State:              "valid",
+				Profile:            site.Profile,
+				ProfileDescription: profileDescription,
+			}
 		}
 	}
 
@@ -73,6 +111,7 @@ func newHandler(cfg *config.Config, registry prometheus.Registerer) (http.Handle
 		htmlTemplate: html,
 		textTemplate: text,
 		domains:      domains,
+		noCRL:        noCRL,
 	}), nil
 }
 
@@ -120,6 +159,10 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if info.State == "revoked" {
+		info.NoCRLPolicies = h.noCRL(r.TLS.ServerName)
+	}
+
 	tmpl, contentType := h.getTmpl(r.URL.RawQuery, r.Header.Get("Accept"))
 
 	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
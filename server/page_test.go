@@ -17,7 +17,12 @@ func TestNewHandler(t *testing.T) {
 	testCfg := config.Config{
 		Sites: []config.Site{
 			{
-				IssuerCN: "used car sales",
+				IssuerCN:         "used car sales",
+				RevocationReason: "superseded",
+				Profile:          "shortlived",
+				AlternateChains: []config.AlternateChain{
+					{Domain: "cross-signed.test", IssuerCN: "used boat sales"},
+				},
 				Domains: config.Domains{
 					Valid:   "valid.test",
 					Expired: "expired.test",
@@ -27,7 +32,16 @@ func TestNewHandler(t *testing.T) {
 		},
 	}
 
-	defaultHandler, err := newHandler(&testCfg, nil)
+	profiles := map[string]string{"valid.test": "Six day certificates"}
+	noCRL := func(domain string) map[string]string {
+		if domain != "revoked.test" {
+			t.Errorf("Unexpected no-CRL outcome lookup for %s", domain)
+		}
+
+		return map[string]string{config.KeyTypeP256: config.NoCRLAssumeRevoked}
+	}
+
+	defaultHandler, err := newHandler(&testCfg, profiles, noCRL, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,6 +55,7 @@ func TestNewHandler(t *testing.T) {
 	.Domain: {{ .Domain }}
 	.Info.IssuerCN: {{ .Info.IssuerCN }}
 	.Info.State: {{ .Info.State }}
+	.Info.RevocationReason: {{ .Info.RevocationReason }}
 	`
 
 	err = os.WriteFile(testTextTmpl, []byte(customTextTemplate), 0o600)
@@ -62,7 +77,7 @@ func TestNewHandler(t *testing.T) {
 
 	testCfg.TextTemplate = testTextTmpl
 	testCfg.HTMLTemplate = testHTMLTmpl
-	customHandler, err := newHandler(&testCfg, nil)
+	customHandler, err := newHandler(&testCfg, profiles, noCRL, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -100,7 +115,19 @@ func TestNewHandler(t *testing.T) {
 			url:     "/?txt",
 			bodyHas: []string{
 				"# revoked.test",
-				"The certificate is revoked.",
+				"The certificate is revoked, with reason superseded.",
+				"The p256 certificate has no CRL distribution point, so the assume-revoked policy was applied.",
+				"It was issued with the shortlived profile. The CA describes it as: Six day certificates",
+			},
+		},
+		{
+			domain:  "cross-signed.test",
+			handler: defaultHandler,
+			url:     "/?html",
+			bodyHas: []string{
+				"It is using a certificate issued by <code>used boat sales</code>",
+				"The certificate is valid.",
+				"It was issued with the <code>shortlived</code> profile. The CA describes it as: Six day certificates",
 			},
 		},
 		{
@@ -110,6 +137,7 @@ func TestNewHandler(t *testing.T) {
 			bodyHas: []string{
 				"Text Template",
 				".Domain: revoked.test",
+				".Info.RevocationReason: superseded",
 			},
 		},
 		{
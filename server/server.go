@@ -4,7 +4,11 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
@@ -13,17 +17,33 @@ import (
 	"github.com/letsencrypt/test-certs-site/config"
 )
 
+// We want http requests to time out relatively quickly, as this server shouldn't be doing much.
+const timeout = 5 * time.Second
+
 // GetCertificateFunc is the type of the TLSConfig.GetCertificate function.
 // The webserver will use it to obtain certificates, including fulfilling
 // ACME TLS-ALPN-01 challenges.
 type GetCertificateFunc func(info *tls.ClientHelloInfo) (*tls.Certificate, error)
 
-// Run the server, until the context is canceled.
-func Run(ctx context.Context, cfg *config.Config, registry prometheus.Registerer, getCert GetCertificateFunc) error {
-	// We want http requests to time out relatively quickly, as this server shouldn't be doing much.
-	const timeout = 5 * time.Second
+// NoCRLOutcomeFunc returns the no-CRL policy applied to each of a revoked domain's current certificates
+// without a CRL distribution point, by key type.
+type NoCRLOutcomeFunc func(domain string) map[string]string
 
-	handler, err := newHandler(cfg, registry)
+// Run the server, until the context is canceled.
+// profiles maps each site's valid domain to its profile's description, to show on its pages,
+// and noCRL is shown on revoked sites' pages.
+// If cfg.HTTPListenAddr is set, challenges is also served over plain HTTP to fulfill
+// ACME HTTP-01 challenges.
+func Run(
+	ctx context.Context,
+	cfg *config.Config,
+	registry prometheus.Registerer,
+	profiles map[string]string,
+	getCert GetCertificateFunc,
+	noCRL NoCRLOutcomeFunc,
+	challenges http.Handler,
+) error {
+	handler, err := newHandler(cfg, profiles, noCRL, registry)
 	if err != nil {
 		return err
 	}
@@ -48,7 +68,20 @@ func Run(ctx context.Context, cfg *config.Config, registry prometheus.Registerer
 		},
 	}
 
-	// Wait for a signal to shut down the server.
+	var challengeListener net.Listener
+	if cfg.HTTPListenAddr != "" {
+		// Listen before serving, so an address that can't be used fails startup instead of only being logged
+		var lc net.ListenConfig
+		challengeListener, err = lc.Listen(ctx, "tcp", cfg.HTTPListenAddr)
+		if err != nil {
+			return fmt.Errorf("listening for HTTP-01 challenges: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Wait for a signal, or the challenge server failing, to shut down the server.
 	go func() {
 		<-ctx.Done()
 
@@ -58,5 +91,55 @@ func Run(ctx context.Context, cfg *config.Config, registry prometheus.Registerer
 		}
 	}()
 
-	return srv.ListenAndServeTLS("", "")
+	challengeErr := make(chan error, 1)
+	if challengeListener != nil {
+		go func() {
+			err := serveHTTP(ctx, challengeListener, challenges, logger)
+			if err != nil {
+				challengeErr <- fmt.Errorf("serving HTTP-01 challenges: %w", err)
+				cancel()
+			}
+		}()
+	}
+
+	err = srv.ListenAndServeTLS("", "")
+
+	select {
+	case err := <-challengeErr:
+		// The challenge server failed, and shut this one down
+		return err
+	default:
+		return err
+	}
+}
+
+// serveHTTP serves HTTP-01 challenges on a plain HTTP listener, until the context is canceled.
+func serveHTTP(ctx context.Context, listener net.Listener, challenges http.Handler, logger *log.Logger) error {
+	srv := http.Server{
+		Handler:  challenges,
+		ErrorLog: logger,
+
+		IdleTimeout:       timeout,
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		WriteTimeout:      timeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		err := srv.Shutdown(context.WithoutCancel(ctx))
+		if err != nil {
+			slog.Error("challenge server error", slog.String("error", err.Error()))
+		}
+	}()
+
+	slog.Info("Challenge server listening", slog.String("httpListenAddr", listener.Addr().String()))
+
+	err := srv.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
 }
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// TestRunChallengeAddrInUse checks the server fails to start if it can't listen for HTTP-01 challenges.
+func TestRunChallengeAddrInUse(t *testing.T) {
+	t.Parallel()
+
+	var lc net.ListenConfig
+	taken, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cfg := config.Config{
+		ListenAddr:     "127.0.0.1:0",
+		HTTPListenAddr: taken.Addr().String(),
+	}
+
+	err = Run(t.Context(), &cfg, nil, nil, nil, nil, http.NotFoundHandler())
+	if err == nil {
+		t.Fatal("Expected an error listening on an address in use")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenges := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("vinaigrette"))
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error)
+	go func() {
+		served <- serveHTTP(ctx, listener, challenges, nil)
+	}()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "vinaigrette" {
+		t.Fatalf("Expected the challenge response, got %q", body)
+	}
+
+	// Canceling the context shuts the server down cleanly
+	cancel()
+
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+}
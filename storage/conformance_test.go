@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// testConformance runs the tests every storage backend must pass.
+// newStorage creates an empty instance of the backend, returning a function that opens a handle on it.
+// Handles should share nothing but the instance, as separate processes using it would.
+func testConformance(t *testing.T, newStorage func(t *testing.T) func() Storage) {
+	t.Helper()
+
+	for name, test := range map[string]func(*testing.T, Storage){
+		"lifecycle":          testLifecycle,
+		"missing":            testMissing,
+		"account":            testAccount,
+		"pending-revocation": testPendingRevocation,
+		"rejections":         testRejections,
+		"remove-current":     testRemoveCurrent,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			test(t, newStorage(t)())
+		})
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		testConcurrent(t, newStorage(t))
+	})
+}
+
+// testLifecycle goes through the expected storage lifecycle.
+func testLifecycle(t *testing.T, storage Storage) {
+	const domain = "interesting.salad"
+
+	// Go through the lifecycle once with each key type
+	for i, keyType := range []string{
+		config.KeyTypeP256,
+		config.KeyTypeRSA2048,
+		config.KeyTypeP384,
+		config.KeyTypeRSA3072,
+		config.KeyTypeEd25519,
+		config.KeyTypeRSA4096,
+	} {
+		key, err := storage.StoreNextKey(domain, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Outside of tests, this would come from a CA:
+		certs := testCert(t, domain, key)
+
+		err = storage.StoreNextCert(domain, certs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Store a different number of alternate chains each time, to check old ones are replaced
+		alternates := make([][]byte, i%3)
+		for idx := range alternates {
+			alternates[idx] = certs
+		}
+
+		err = storage.StoreNextAlternates(domain, alternates)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, err := storage.ReadNext(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A real user of the storage package would validate the certs here.
+		// Eg, checking if they're expired or revoked.
+
+		taken, err := storage.TakeNext(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		current, err := storage.ReadCurrent(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if current.Leaf.DNSNames[0] != domain {
+			t.Fatalf("Expected %s DNS SAN", domain)
+		}
+
+		if !current.Leaf.Equal(taken.Leaf) || !current.Leaf.Equal(next.Leaf) {
+			t.Fatal("Current certificate isn't the one taken")
+		}
+
+		currentAlternates, err := storage.ReadCurrentAlternates(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(currentAlternates) != len(alternates) {
+			t.Fatalf("Expected %d alternate chains, got %d", len(alternates), len(currentAlternates))
+		}
+	}
+
+	// A next certificate's alternate chains are cleared when it's replaced
+	key, err := storage.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.StoreNextAlternates(domain, [][]byte{testCert(t, domain, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeTestNext(t, storage, domain)
+
+	_, err = storage.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentAlternates, err := storage.ReadCurrentAlternates(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(currentAlternates) != 0 {
+		t.Fatalf("Expected the replaced certificate's alternate chains to be cleared, got %d", len(currentAlternates))
+	}
+}
+
+// testConcurrent takes the next certificate with one handle, while another handle replaces the next certificate
+// or marks it for revocation. The current key and certificate must match, and neither write may be lost.
+func testConcurrent(t *testing.T, open func() Storage) {
+	taker, writer := open(), open()
+
+	for i := range 6 {
+		domain := fmt.Sprintf("concurrent-%d.salad", i)
+		replace := i%2 == 1
+
+		first := storeTestNext(t, taker, domain)
+
+		var (
+			wg      sync.WaitGroup
+			taken   tls.Certificate
+			takeErr error
+		)
+		wg.Go(func() {
+			taken, takeErr = taker.TakeNext(domain)
+		})
+
+		var second *x509.Certificate
+		if replace {
+			second = storeTestNext(t, writer, domain)
+		} else {
+			err := writer.StorePendingRevocation(domain, PendingRevocation{Attempts: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wg.Wait()
+
+		// TakeNext can only fail if it found the replacement key stored without its certificate yet
+		if takeErr != nil && !replace {
+			t.Fatal(takeErr)
+		}
+
+		if takeErr == nil {
+			// Reading the key pair checks the key matches the certificate
+			current, err := taker.ReadCurrent(domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !current.Leaf.Equal(taken.Leaf) || (!taken.Leaf.Equal(first) && !taken.Leaf.Equal(second)) {
+				t.Fatalf("%s: current certificate isn't the one taken", domain)
+			}
+		}
+
+		if !replace {
+			pending, err := taker.ReadPendingRevocation(domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pending.Attempts != 3 {
+				t.Fatalf("%s: expected the pending revocation to be kept, got %+v", domain, pending)
+			}
+
+			continue
+		}
+
+		// The replacement is either the next certificate, or was taken
+		next, err := taker.ReadNext(domain)
+		if err == nil && !next.Leaf.Equal(second) {
+			t.Fatalf("%s: next certificate isn't the replacement", domain)
+		}
+		if err != nil && (takeErr != nil || !taken.Leaf.Equal(second)) {
+			t.Fatalf("%s: replacement was lost: %v", domain, err)
+		}
+	}
+}
+
+// storeTestNext stores a new next key and certificate for domain, returning the certificate.
+func storeTestNext(t *testing.T, storage Storage, domain string) *x509.Certificate {
+	t.Helper()
+
+	key, err := storage.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := testCert(t, domain, key)
+
+	err = storage.StoreNextCert(domain, certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// testCert returns a test self-signed cert for the given key.
+func testCert(t *testing.T, domain string, key crypto.Signer) []byte {
+	t.Helper()
+
+	// Create a certificate template
+	template := x509.Certificate{
+		DNSNames: []string{domain},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certDER,
+	})
+}
+
+// testMissing checks values that were never stored are reported as not existing.
+func testMissing(t *testing.T, storage Storage) {
+	const domain = "missing.salad"
+
+	_, err := storage.ReadCurrent(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist reading current, got %v", err)
+	}
+
+	_, err = storage.ReadNext(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist reading next, got %v", err)
+	}
+
+	_, err = storage.TakeNext(domain)
+	if err == nil {
+		t.Fatal("Expected an error taking a missing next certificate")
+	}
+
+	alternates, err := storage.ReadCurrentAlternates(domain)
+	if err != nil || len(alternates) != 0 {
+		t.Fatalf("Expected no alternates, got %d and error %v", len(alternates), err)
+	}
+
+	// A next key without a certificate isn't a complete next certificate
+	_, err = storage.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadNext(domain)
+	if err == nil {
+		t.Fatal("Expected an error reading a next key without a certificate")
+	}
+}
+
+// testAccount stores and reads ACME accounts, including one with a key rollover in progress.
+func testAccount(t *testing.T, storage Storage) {
+	dir := "https://acme-v100.api.banana/directory"
+
+	_, err := storage.ReadACME(dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist, got %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "https://acme-v100.api.banana/account/tomato"
+	err = storage.StoreACME(dir, Account{
+		URI:      uri,
+		Key:      key,
+		EABKeyID: "kid-cucumber",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acct, err := storage.ReadACME(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acct.URI != uri {
+		t.Fatalf("Expected %s URI, got %s", uri, acct.URI)
+	}
+
+	if !key.PublicKey.Equal(acct.Key.Public()) {
+		t.Fatalf("Reloaded key does not match")
+	}
+
+	if acct.EABKeyID != "kid-cucumber" {
+		t.Fatalf("Expected EAB key ID kid-cucumber, got %q", acct.EABKeyID)
+	}
+
+	if acct.PreviousKey != nil {
+		t.Fatalf("Expected no previous key")
+	}
+
+	// Store a rollover in progress, which should keep both keys
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Now().Truncate(time.Second)
+	acct.PreviousKey = acct.Key
+	acct.Key = newKey
+	acct.KeyCreated = created
+
+	err = storage.StoreACME(dir, acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acct, err = storage.ReadACME(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !newKey.PublicKey.Equal(acct.Key.Public()) {
+		t.Fatalf("Reloaded new key does not match")
+	}
+
+	if acct.PreviousKey == nil || !key.PublicKey.Equal(acct.PreviousKey.Public()) {
+		t.Fatalf("Reloaded previous key does not match")
+	}
+
+	if !acct.KeyCreated.Equal(created) {
+		t.Fatalf("Expected key created at %s, got %s", created, acct.KeyCreated)
+	}
+}
+
+// testPendingRevocation stores and clears pending revocations, which stop the next key being replaced.
+func testPendingRevocation(t *testing.T, storage Storage) {
+	const domain = "revoked.salad"
+
+	_, err := storage.ReadPendingRevocation(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist, got %v", err)
+	}
+
+	retryAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	err = storage.StorePendingRevocation(domain, PendingRevocation{Attempts: 2, RetryAt: retryAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := storage.ReadPendingRevocation(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending.Attempts != 2 || !pending.RetryAt.Equal(retryAt) {
+		t.Fatalf("Expected 2 attempts and retry at %s, got %+v", retryAt, pending)
+	}
+
+	err = storage.ClearPendingRevocation(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadPendingRevocation(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist after clearing, got %v", err)
+	}
+
+	// A new next key can't replace a certificate that still needs revoking
+	err = storage.StorePendingRevocation(domain, PendingRevocation{KeySPKIHash: "5a1ad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.StoreNextKey(domain, config.KeyTypeP256)
+	if !errors.Is(err, ErrPendingRevocation) {
+		t.Fatalf("Expected ErrPendingRevocation storing a new key, got %v", err)
+	}
+
+	pending, err = storage.ReadPendingRevocation(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending.KeySPKIHash != "5a1ad" {
+		t.Fatalf("Expected the pending revocation to be kept, got %+v", pending)
+	}
+
+	err = storage.ClearPendingRevocation(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRemoveCurrent checks a removed current certificate can't be read.
+func testRemoveCurrent(t *testing.T, storage Storage) {
+	const domain = "wilted.salad"
+
+	err := storage.RemoveCurrent(domain)
+	if err != nil {
+		t.Fatalf("Expected removing nothing to succeed, got %v", err)
+	}
+
+	storeTestNext(t, storage, domain)
+
+	_, err = storage.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.RemoveCurrent(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadCurrent(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist after removing, got %v", err)
+	}
+
+	alternates, err := storage.ReadCurrentAlternates(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alternates) != 0 {
+		t.Fatalf("Expected no alternates after removing, got %d", len(alternates))
+	}
+}
+
+// testRejections checks rejected certificates are recorded until cleared, even as the next key is replaced.
+func testRejections(t *testing.T, storage Storage) {
+	const domain = "rejected.salad"
+
+	_, err := storage.ReadRejections(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist, got %v", err)
+	}
+
+	retryAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	err = storage.StoreRejections(domain, Rejections{Count: 2, Serial: "5a1ad", RetryAt: retryAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeTestNext(t, storage, domain)
+
+	rejections, err := storage.ReadRejections(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rejections.Count != 2 || rejections.Serial != "5a1ad" || !rejections.RetryAt.Equal(retryAt) {
+		t.Fatalf("Expected 2 rejections of 5a1ad, retrying at %s, got %+v", retryAt, rejections)
+	}
+
+	_, err = storage.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.ClearRejections(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadRejections(domain)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist after clearing, got %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// documentStore is a store of named JSON documents with conditional writes, such as a Vault KV secrets engine
+// or an S3 bucket.
+type documentStore interface {
+	// get reads the document called name into doc, returning its version.
+	// A document that doesn't exist leaves doc unchanged, with the version to pass to put to create it.
+	get(name string, doc any) (string, error)
+
+	// put writes doc to name, if its version is still version. Returns errVersionConflict if it isn't.
+	put(name string, doc any, version string) error
+}
+
+// documents keeps keys, certificates and accounts as JSON documents in a documentStore.
+// Each domain's next and current values are kept in one document, replaced with conditional writes,
+// so TakeNext is atomic even with several instances sharing the store.
+type documents struct {
+	store documentStore
+	keys  keyCipher
+}
+
+// domainDocument holds a domain's keys and certificates, as PEM.
+// Keys are encrypted if a key-encryption key is configured.
+type domainDocument struct {
+	NextKey           string             `json:"next_key,omitempty"`
+	NextCert          string             `json:"next_cert,omitempty"`
+	NextAlternates    []string           `json:"next_alternates,omitempty"`
+	PendingRevocation *PendingRevocation `json:"pending_revocation,omitempty"`
+	Rejections        *Rejections        `json:"rejections,omitempty"`
+
+	CurrentKey        string   `json:"current_key,omitempty"`
+	CurrentCert       string   `json:"current_cert,omitempty"`
+	CurrentAlternates []string `json:"current_alternates,omitempty"`
+}
+
+// accountDocument holds an ACME account, as the JSON the files backend stores.
+// It's encrypted if a key-encryption key is configured, as it includes the account's private key.
+type accountDocument struct {
+	Account string `json:"account"`
+}
+
+// ReadACME returns the stored ACME account for a given ACME server, identified by its directory URL.
+func (d *documents) ReadACME(directory string) (Account, error) {
+	if directory == "" {
+		return Account{}, errors.New("no ACME directory specified")
+	}
+
+	var doc accountDocument
+	_, err := d.store.get(accountDocumentName(directory), &doc)
+	if err != nil {
+		return Account{}, err
+	}
+	if doc.Account == "" {
+		return Account{}, fmt.Errorf("no ACME account for %s: %w", directory, os.ErrNotExist)
+	}
+
+	accountJSON, err := d.keys.open([]byte(doc.Account), accountLocation(directory))
+	if err != nil {
+		return Account{}, fmt.Errorf("reading ACME account for %s: %w", directory, err)
+	}
+
+	return unmarshalAccount(accountJSON)
+}
+
+// StoreACME persists an account, for later retrieval with ReadACME.
+func (d *documents) StoreACME(directory string, acct Account) error {
+	accountJSON, err := marshalAccount(acct)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := d.keys.seal(accountJSON, accountLocation(directory))
+	if err != nil {
+		return err
+	}
+
+	err = updateDocument(d, accountDocumentName(directory), func(doc *accountDocument) error {
+		doc.Account = string(sealed)
+
+		return nil
+	})
+
+	return err
+}
+
+// StorePendingRevocation marks the next certificate as needing revocation.
+func (d *documents) StorePendingRevocation(domain string, pending PendingRevocation) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.PendingRevocation = &pending
+
+		return nil
+	})
+
+	return err
+}
+
+// ReadPendingRevocation returns the revocation state of the next certificate.
+// Returns an error wrapping os.ErrNotExist if the certificate doesn't need revoking.
+func (d *documents) ReadPendingRevocation(domain string) (PendingRevocation, error) {
+	doc, err := d.readDomain(domain)
+	if err != nil {
+		return PendingRevocation{}, err
+	}
+
+	if doc.PendingRevocation == nil {
+		return PendingRevocation{}, fmt.Errorf("no pending revocation for %s: %w", domain, os.ErrNotExist)
+	}
+
+	return *doc.PendingRevocation, nil
+}
+
+// ClearPendingRevocation marks the next certificate as revoked.
+func (d *documents) ClearPendingRevocation(domain string) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.PendingRevocation = nil
+
+		return nil
+	})
+
+	return err
+}
+
+// StoreRejections records the next certificates rejected in a row.
+func (d *documents) StoreRejections(domain string, rejections Rejections) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.Rejections = &rejections
+
+		return nil
+	})
+
+	return err
+}
+
+// ReadRejections returns the next certificates rejected in a row.
+// Returns an error wrapping os.ErrNotExist if none were.
+func (d *documents) ReadRejections(domain string) (Rejections, error) {
+	doc, err := d.readDomain(domain)
+	if err != nil {
+		return Rejections{}, err
+	}
+
+	if doc.Rejections == nil {
+		return Rejections{}, fmt.Errorf("no rejections for %s: %w", domain, os.ErrNotExist)
+	}
+
+	return *doc.Rejections, nil
+}
+
+// ClearRejections records that a next certificate was used.
+func (d *documents) ClearRejections(domain string) error {
+	doc, err := d.readDomain(domain)
+	if err != nil || doc.Rejections == nil {
+		return err
+	}
+
+	err = updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.Rejections = nil
+
+		return nil
+	})
+
+	return err
+}
+
+// StoreNextKey generates a new next key. The next certificate is cleared.
+// Returns ErrPendingRevocation if it hasn't been revoked yet.
+func (d *documents) StoreNextKey(domain string, keyType string) (crypto.Signer, error) {
+	key, pemBytes, err := newKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := d.keys.seal(pemBytes, keyLocation(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		if doc.PendingRevocation != nil {
+			return fmt.Errorf("storing next key for %s: %w", domain, ErrPendingRevocation)
+		}
+
+		doc.NextKey = string(sealed)
+		doc.NextCert = ""
+		doc.NextAlternates = nil
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// StoreNextCert stores the next certificate for the domain, as a PEM sequence.
+func (d *documents) StoreNextCert(domain string, certificates []byte) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.NextCert = string(certificates)
+
+		return nil
+	})
+
+	return err
+}
+
+// StoreNextAlternates stores the next certificate's alternate chains, replacing any stored before.
+func (d *documents) StoreNextAlternates(domain string, chains [][]byte) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.NextAlternates = nil
+		for _, chain := range chains {
+			doc.NextAlternates = append(doc.NextAlternates, string(chain))
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// TakeNext makes the next key, certificate and alternate chains current, in one conditional write.
+func (d *documents) TakeNext(domain string) (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		var err error
+		cert, err = d.keyPair(domain, doc.NextCert, doc.NextKey)
+		if err != nil {
+			return fmt.Errorf("reading next certificate: %w", err)
+		}
+
+		doc.CurrentKey = doc.NextKey
+		doc.CurrentCert = doc.NextCert
+		doc.CurrentAlternates = doc.NextAlternates
+		doc.NextKey = ""
+		doc.NextCert = ""
+		doc.NextAlternates = nil
+
+		return nil
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return cert, nil
+}
+
+// RemoveCurrent removes the current cert, key and alternate chains for this domain.
+func (d *documents) RemoveCurrent(domain string) error {
+	err := updateDocument(d, domainDocumentName(domain), func(doc *domainDocument) error {
+		doc.CurrentKey = ""
+		doc.CurrentCert = ""
+		doc.CurrentAlternates = nil
+
+		return nil
+	})
+
+	return err
+}
+
+// ReadCurrent reads the current cert and key for this domain.
+func (d *documents) ReadCurrent(domain string) (tls.Certificate, error) {
+	doc, err := d.readDomain(domain)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return d.keyPair(domain, doc.CurrentCert, doc.CurrentKey)
+}
+
+// ReadCurrentAlternates reads the current key with each of the current certificate's alternate chains.
+func (d *documents) ReadCurrentAlternates(domain string) ([]tls.Certificate, error) {
+	doc, err := d.readDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	alternates := make([]tls.Certificate, 0, len(doc.CurrentAlternates))
+	for idx, chain := range doc.CurrentAlternates {
+		cert, err := d.keyPair(domain, chain, doc.CurrentKey)
+		if err != nil {
+			return nil, fmt.Errorf("reading alternate chain %d: %w", idx, err)
+		}
+		alternates = append(alternates, cert)
+	}
+
+	return alternates, nil
+}
+
+// ReadNext reads the next cert and key for this domain.
+func (d *documents) ReadNext(domain string) (tls.Certificate, error) {
+	doc, err := d.readDomain(domain)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return d.keyPair(domain, doc.NextCert, doc.NextKey)
+}
+
+// readDomain reads a domain's document, which is empty if nothing was stored for it.
+func (d *documents) readDomain(domain string) (domainDocument, error) {
+	var doc domainDocument
+	_, err := d.store.get(domainDocumentName(domain), &doc)
+
+	return doc, err
+}
+
+// keyPair parses a PEM certificate and a domain's possibly encrypted PEM key, either of which may not have been
+// stored.
+func (d *documents) keyPair(domain, certPEM, keyPEM string) (tls.Certificate, error) {
+	keyBytes, err := d.keys.open([]byte(keyPEM), keyLocation(domain))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("reading key: %w", err)
+	}
+
+	return parseKeyPair([]byte(certPEM), keyBytes)
+}
+
+// updateDocument reads the document called name, changes it with modify, and writes it back if it hasn't
+// changed since. If another writer changed the document in between, it's read and modified again.
+func updateDocument[T any](d *documents, name string, modify func(*T) error) error {
+	for range updateAttempts {
+		var doc T
+		version, err := d.store.get(name, &doc)
+		if err != nil {
+			return err
+		}
+
+		err = modify(&doc)
+		if err != nil {
+			return err
+		}
+
+		err = d.store.put(name, doc, version)
+		if !errors.Is(err, errVersionConflict) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("updating %s: %w", name, errVersionConflict)
+}
+
+// domainDocumentName is the name of the document for a domain's keys and certificates.
+func domainDocumentName(domain string) string {
+	return "domains/" + domain
+}
+
+// accountDocumentName is the name of the document for an ACME account.
+// Directory URLs are encoded, as their slashes would otherwise nest the document.
+func accountDocumentName(directory string) string {
+	return "accounts/" + base64.RawURLEncoding.EncodeToString([]byte(directory))
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// memoryDocuments is a documentStore in memory, counting each document's versions.
+type memoryDocuments struct {
+	// mu protects the fields below
+	mu sync.Mutex
+
+	docs     map[string][]byte
+	versions map[string]int
+
+	// beforePut, if set, is called before each put is applied
+	beforePut func()
+}
+
+func (m *memoryDocuments) get(name string, doc any) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.docs[name]; ok {
+		err := json.Unmarshal(stored, doc)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strconv.Itoa(m.versions[name]), nil
+}
+
+func (m *memoryDocuments) put(name string, doc any, version string) error {
+	m.mu.Lock()
+	beforePut := m.beforePut
+	m.mu.Unlock()
+
+	if beforePut != nil {
+		beforePut()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if version != strconv.Itoa(m.versions[name]) {
+		return errVersionConflict
+	}
+
+	stored, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	m.docs[name] = stored
+	m.versions[name]++
+
+	return nil
+}
+
+// newTestDocuments returns documents in memory, encrypting keys with keys.
+func newTestDocuments(keys keyCipher) (*memoryDocuments, *documents) {
+	store := &memoryDocuments{docs: make(map[string][]byte), versions: make(map[string]int)}
+
+	return store, &documents{store: store, keys: keys}
+}
+
+// testKeyCipher returns a keyCipher with a new key-encryption key.
+func testKeyCipher(t *testing.T) keyCipher {
+	t.Helper()
+
+	kek := make([]byte, aesKeySize)
+	_, _ = rand.Read(kek)
+
+	keys, err := newKeyCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestDocuments(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, func(t *testing.T) func() Storage {
+		t.Helper()
+
+		store, _ := newTestDocuments(keyCipher{})
+
+		return func() Storage {
+			return &documents{store: store}
+		}
+	})
+}
+
+func TestDocumentsEncrypted(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, func(t *testing.T) func() Storage {
+		t.Helper()
+
+		keys := testKeyCipher(t)
+		store, _ := newTestDocuments(keys)
+
+		t.Cleanup(func() {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+
+			for name, doc := range store.docs {
+				if bytes.Contains(doc, []byte("PRIVATE KEY")) || bytes.Contains(doc, []byte("PrivateKey")) {
+					t.Errorf("%s has an unencrypted private key", name)
+				}
+			}
+		})
+
+		return func() Storage {
+			return &documents{store: store, keys: keys}
+		}
+	})
+}
+
+// TestDocumentsConflict checks an update isn't lost when another writer changes the document at the same time.
+func TestDocumentsConflict(t *testing.T) {
+	t.Parallel()
+
+	store, storage := newTestDocuments(keyCipher{})
+
+	const domain = "contested.salad+rsa2048"
+
+	key, err := storage.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.StoreNextCert(domain, testCert(t, domain, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance marks the certificate for revocation while this one takes it
+	var done atomic.Bool
+	store.mu.Lock()
+	store.beforePut = func() {
+		if done.CompareAndSwap(false, true) {
+			err := storage.StorePendingRevocation(domain, PendingRevocation{Attempts: 3})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	store.mu.Unlock()
+
+	_, err = storage.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadCurrent(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := storage.ReadPendingRevocation(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Attempts != 3 {
+		t.Fatalf("Expected the concurrent write to be kept, got %+v", pending)
+	}
+}
+
+// TestDocumentsEncryptionKey checks that keys stored unencrypted can still be read once encryption is enabled,
+// but encrypted keys can't be read without the key-encryption key.
+func TestDocumentsEncryptionKey(t *testing.T) {
+	t.Parallel()
+
+	store, plain := newTestDocuments(keyCipher{})
+	encrypted := &documents{store: store, keys: testKeyCipher(t)}
+
+	for _, tc := range []struct {
+		name           string
+		store, read    *documents
+		wantReadFailed bool
+	}{
+		{name: "plaintext-read-encrypted", store: plain, read: encrypted},
+		{name: "encrypted-read-plaintext", store: encrypted, read: plain, wantReadFailed: true},
+	} {
+		domain := tc.name + ".salad"
+
+		key, err := tc.store.StoreNextKey(domain, config.KeyTypeP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tc.store.StoreNextCert(domain, testCert(t, domain, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tc.read.ReadNext(domain)
+		if tc.wantReadFailed && err == nil {
+			t.Fatalf("%s: expected an error", tc.name)
+		}
+		if !tc.wantReadFailed && err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+	}
+}
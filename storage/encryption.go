@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// encryptedBlockType is the PEM block type of encrypted data.
+	encryptedBlockType = "TEST-CERTS-SITE ENCRYPTED DATA"
+
+	// dataKeyHeader is the PEM header with the data key, encrypted with the key-encryption key.
+	dataKeyHeader = "Data-Key"
+
+	// aesKeySize of the key-encryption key and data keys, for AES-256.
+	aesKeySize = 32
+)
+
+// encryptionKeyEnv is the environment variable a base64 encoded key-encryption key can be set in,
+// instead of a file.
+const encryptionKeyEnv = "TEST_CERTS_SITE_ENCRYPTION_KEY"
+
+// keyCipher does envelope encryption of private keys: each is encrypted with a new data key,
+// and the data key is encrypted with the key-encryption key. Both use AES-256-GCM.
+// The zero keyCipher leaves data unencrypted.
+type keyCipher struct {
+	kek cipher.AEAD
+
+	// warned is the set of locations an unencrypted key was read from, so each is only logged once
+	warned *sync.Map
+}
+
+// loadKEK reads a base64 encoded key-encryption key from path, or else from env, the value of the
+// TEST_CERTS_SITE_ENCRYPTION_KEY environment variable. Returns nil if neither is set.
+func loadKEK(path, env string) ([]byte, error) {
+	encoded, source := env, encryptionKeyEnv
+	if path != "" {
+		encodedBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading key-encryption key: %w", err)
+		}
+
+		encoded, source = string(encodedBytes), path
+		if strings.TrimSpace(encoded) == "" {
+			return nil, fmt.Errorf("no key-encryption key in %s", path)
+		}
+	}
+
+	if encoded == "" {
+		return nil, nil
+	}
+
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key-encryption key from %s: %w", source, err)
+	}
+
+	return kek, nil
+}
+
+// newKeyCipher returns a keyCipher using a 256-bit key-encryption key.
+// If kek is nil, the zero keyCipher is returned, so keys aren't encrypted.
+func newKeyCipher(kek []byte) (keyCipher, error) {
+	if kek == nil {
+		return keyCipher{}, nil
+	}
+
+	if len(kek) != aesKeySize {
+		return keyCipher{}, fmt.Errorf("key-encryption key is %d bytes, but must be %d", len(kek), aesKeySize)
+	}
+
+	aead, err := newGCM(kek)
+	if err != nil {
+		return keyCipher{}, err
+	}
+
+	return keyCipher{kek: aead, warned: &sync.Map{}}, nil
+}
+
+// enabled reports whether data is encrypted by seal.
+func (c keyCipher) enabled() bool {
+	return c.kek != nil
+}
+
+// keyLocation is where a domain's private keys are stored. Keys are bound to it when they're encrypted,
+// so they can't be swapped with another domain's, or an ACME account. It doesn't include the version,
+// as TakeNext moves keys from next to current.
+func keyLocation(domain string) string {
+	return "key:" + domain
+}
+
+// accountLocation is where the ACME account for the ACME server at directory is stored.
+// Accounts are bound to it when they're encrypted.
+func accountLocation(directory string) string {
+	return "account:" + directory
+}
+
+// seal encrypts plaintext stored at location, returning it as a PEM block with its encrypted data key.
+// Opening it needs the same location.
+func (c keyCipher) seal(plaintext []byte, location string) ([]byte, error) {
+	if !c.enabled() {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, aesKeySize)
+	_, _ = rand.Read(dataKey) // Never returns an error
+
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedBlockType,
+		Headers: map[string]string{dataKeyHeader: base64.StdEncoding.EncodeToString(sealGCM(c.kek, dataKey, location))},
+		Bytes:   sealGCM(data, plaintext, location),
+	}), nil
+}
+
+// open decrypts data encrypted by seal for location. Anything else is returned unchanged,
+// so data stored before encryption was enabled can still be read.
+func (c keyCipher) open(data []byte, location string) ([]byte, error) {
+	block := sealedBlock(data)
+	if block == nil {
+		if c.enabled() && len(data) > 0 {
+			_, warned := c.warned.LoadOrStore(location, true)
+			if !warned {
+				slog.Warn("Read an unencrypted private key, though a key-encryption key is configured",
+					slog.String("location", location))
+			}
+		}
+
+		return data, nil
+	}
+
+	if !c.enabled() {
+		return nil, errors.New("data is encrypted, but no key-encryption key is configured")
+	}
+
+	sealedKey, err := base64.StdEncoding.DecodeString(block.Headers[dataKeyHeader])
+	if err != nil {
+		return nil, fmt.Errorf("decoding data key: %w", err)
+	}
+
+	dataKey, err := openGCM(c.kek, sealedKey, location)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openGCM(aead, block.Bytes, location)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// sealedBlock returns the PEM block of data encrypted by seal, or nil if data isn't encrypted.
+func sealedBlock(data []byte) *pem.Block {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedBlockType {
+		return nil
+	}
+
+	return block
+}
+
+// newGCM returns AES-GCM with key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealGCM encrypts plaintext with a random nonce, which is prepended to the ciphertext.
+// The location is authenticated as additional data.
+func sealGCM(aead cipher.AEAD, plaintext []byte, location string) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce) // Never returns an error
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(location))
+}
+
+// openGCM decrypts ciphertext from sealGCM, for the same location.
+func openGCM(aead cipher.AEAD, ciphertext []byte, location string) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(location))
+}
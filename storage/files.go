@@ -0,0 +1,541 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	privateKeyFilename  = "private.pem"
+	certificateFilename = "certificate.pem"
+	acmeAccountFilename = "acme.json"
+	revocationFilename  = "revocation.json"
+	rejectionsFilename  = "rejections.json"
+
+	// alternateFilename is formatted with the index of the alternate chain.
+	alternateFilename = "alternate-%d.pem"
+	alternatePattern  = "alternate-*.pem"
+)
+
+const (
+	// dirPerms rwxr-xr-x for created directories. Writable only by user, but global r & x for debugging.
+	dirPerms = 0o755
+
+	// keyPerms rw------- for private keys. No permissions outside of user.
+	keyPerms = 0o600
+
+	// certPerms rw-r--r-- for cert files. Globally readable certs for debugging.
+	certPerms = 0o644
+)
+
+// Files is the default storage backend, keeping files in a directory on disk.
+// Private keys and ACME accounts can be encrypted before they're written.
+type Files struct {
+	// mu prevents simultaneous writing of files, or reading while writing.
+	mu   sync.Mutex
+	dir  string
+	keys keyCipher
+}
+
+// NewFiles returns storage in the directory storageDir.
+// Private keys and ACME accounts are encrypted with kek, a 256-bit key-encryption key, unless it's nil.
+func NewFiles(storageDir string, kek []byte) (*Files, error) {
+	keys, err := newKeyCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Files{dir: storageDir, keys: keys}, nil
+}
+
+// ReadACME returns the stored ACME account for a given ACME server, identified by its directory URL.
+// If an account was previously saved, it is returned with its private key.
+func (s *Files) ReadACME(directory string) (Account, error) {
+	if directory == "" {
+		return Account{}, errors.New("no ACME directory specified")
+	}
+
+	accountData, err := os.ReadFile(s.pathFor(url.PathEscape(directory), current, acmeAccountFilename))
+	if err != nil {
+		return Account{}, err
+	}
+
+	accountJSON, err := s.keys.open(accountData, accountLocation(directory))
+	if err != nil {
+		return Account{}, fmt.Errorf("reading ACME account for %s: %w", directory, err)
+	}
+
+	return unmarshalAccount(accountJSON)
+}
+
+// StoreACME persists an account to disk, for later retrieval with ReadACME.
+func (s *Files) StoreACME(directory string, acct Account) error {
+	accountJSON, err := marshalAccount(acct)
+	if err != nil {
+		return err
+	}
+
+	accountData, err := s.keys.seal(accountJSON, accountLocation(directory))
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.pathFor(url.PathEscape(directory), current, ""), dirPerms)
+	if err != nil {
+		return err
+	}
+
+	// A crash can't leave a truncated account. That matters most during a key rollover,
+	// when losing either key could strand the account.
+	return writeFileAtomic(s.pathFor(url.PathEscape(directory), current, acmeAccountFilename), accountData)
+}
+
+// StorePendingRevocation marks the next certificate as needing revocation.
+// It should be stored before the certificate is requested, so a crash can't leave an issued certificate without it.
+func (s *Files) StorePendingRevocation(domain string, pending PendingRevocation) error {
+	pendingJSON, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+
+	path := s.pathFor(domain, next, revocationFilename)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(path), dirPerms)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pendingJSON, certPerms)
+}
+
+// ReadPendingRevocation returns the revocation state of the next certificate.
+// Returns an error wrapping os.ErrNotExist if the certificate doesn't need revoking.
+func (s *Files) ReadPendingRevocation(domain string) (PendingRevocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pendingJSON, err := os.ReadFile(s.pathFor(domain, next, revocationFilename))
+	if err != nil {
+		return PendingRevocation{}, err
+	}
+
+	var pending PendingRevocation
+	err = json.Unmarshal(pendingJSON, &pending)
+	if err != nil {
+		return PendingRevocation{}, fmt.Errorf("reading pending revocation json: %w", err)
+	}
+
+	return pending, nil
+}
+
+// ClearPendingRevocation marks the next certificate as revoked.
+func (s *Files) ClearPendingRevocation(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.pathFor(domain, next, revocationFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// StoreRejections records the next certificates rejected in a row.
+func (s *Files) StoreRejections(domain string, rejections Rejections) error {
+	rejectionsJSON, err := json.Marshal(rejections)
+	if err != nil {
+		return err
+	}
+
+	path := s.pathFor(domain, next, rejectionsFilename)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(path), dirPerms)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, rejectionsJSON, certPerms)
+}
+
+// ReadRejections returns the next certificates rejected in a row.
+// Returns an error wrapping os.ErrNotExist if none were.
+func (s *Files) ReadRejections(domain string) (Rejections, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rejectionsJSON, err := os.ReadFile(s.pathFor(domain, next, rejectionsFilename))
+	if err != nil {
+		return Rejections{}, err
+	}
+
+	var rejections Rejections
+	err = json.Unmarshal(rejectionsJSON, &rejections)
+	if err != nil {
+		return Rejections{}, fmt.Errorf("reading rejections json: %w", err)
+	}
+
+	return rejections, nil
+}
+
+// ClearRejections records that a next certificate was used.
+func (s *Files) ClearRejections(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.pathFor(domain, next, rejectionsFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// StoreNextKey generates a new "next" key, writing it to disk.
+// Any alternate chains are cleared, as the next certificate they were for is being replaced.
+// Returns ErrPendingRevocation if the next certificate hasn't been revoked yet.
+func (s *Files) StoreNextKey(domain string, keyType string) (crypto.Signer, error) {
+	key, pemBytes, err := newKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := s.keys.seal(pemBytes, keyLocation(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	path := s.pathFor(domain, next, privateKeyFilename)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = os.Stat(s.pathFor(domain, next, revocationFilename))
+	if err == nil {
+		return nil, fmt.Errorf("storing next key for %s: %w", domain, ErrPendingRevocation)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), dirPerms)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, keyData, keyPerms)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.removeAlternates(domain, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// StoreNextCert stores the next certificate for the domain.
+// Certificates should be a PEM sequence to write to disk.
+func (s *Files) StoreNextCert(domain string, certificates []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certPath := s.pathFor(domain, next, certificateFilename)
+	err := os.WriteFile(certPath, certificates, certPerms)
+	if err != nil {
+		return fmt.Errorf("could not write certificate: %w", err)
+	}
+
+	return nil
+}
+
+// StoreNextAlternates stores the next certificate's alternate chains, replacing any stored before.
+// Each should be a PEM sequence, starting with the same leaf as the certificate from StoreNextCert.
+func (s *Files) StoreNextAlternates(domain string, chains [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.removeAlternates(domain, next)
+	if err != nil {
+		return err
+	}
+
+	for idx, chain := range chains {
+		err := os.WriteFile(s.pathFor(domain, next, fmt.Sprintf(alternateFilename, idx)), chain, certPerms)
+		if err != nil {
+			return fmt.Errorf("could not write alternate chain: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// TakeNext overwrites the current cert/key with the next cert/key, and returns the new current values.
+// Alternate chains are replaced too.
+func (s *Files) TakeNext(domain string) (tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.MkdirAll(s.pathFor(domain, current, ""), dirPerms)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// Read the next values we're about to make current.
+	// Doing this before renaming ensures the key and certificate match.
+	cert, err := s.read(domain, next)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("reading next certificate: %w", err)
+	}
+
+	alternates, err := filepath.Glob(s.pathFor(domain, next, alternatePattern))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	err = s.removeAlternates(domain, current)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	files := []string{privateKeyFilename, certificateFilename}
+	for _, path := range alternates {
+		files = append(files, filepath.Base(path))
+	}
+
+	for _, path := range files {
+		nextPath := s.pathFor(domain, next, path)
+		currPath := s.pathFor(domain, current, path)
+		err := os.Rename(nextPath, currPath)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return cert, nil
+}
+
+// RemoveCurrent removes the current cert, key and alternate chains for this domain.
+// The certificate is removed first, so it can't be read without the others.
+func (s *Files) RemoveCurrent(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range []string{certificateFilename, privateKeyFilename} {
+		err := os.Remove(s.pathFor(domain, current, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return s.removeAlternates(domain, current)
+}
+
+// ReadCurrent reads the current cert and key for this domain.
+// Returns an error if the stored value couldn't be read or parsed.
+func (s *Files) ReadCurrent(domain string) (tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(domain, current)
+}
+
+// ReadCurrentAlternates reads the current key with each of the current certificate's alternate chains.
+// Returns an empty list if there are none.
+func (s *Files) ReadCurrentAlternates(domain string) ([]tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(s.pathFor(domain, current, alternatePattern))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return []tls.Certificate{}, nil
+	}
+
+	keyPEM, err := s.readKey(domain, current)
+	if err != nil {
+		return nil, err
+	}
+
+	alternates := make([]tls.Certificate, 0, len(paths))
+	for _, path := range paths {
+		chain, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(chain, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("reading alternate chain %s: %w", filepath.Base(path), err)
+		}
+		alternates = append(alternates, cert)
+	}
+
+	return alternates, nil
+}
+
+// ReadNext reads the next cert and key for this domain.
+// Returns an error if the stored value couldn't be read or parsed.
+func (s *Files) ReadNext(domain string) (tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(domain, next)
+}
+
+// read a cert and key. Common logic for ReadCurrent and ReadNext. Caller should hold mu.
+func (s *Files) read(domain string, ver version) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(s.pathFor(domain, ver, certificateFilename))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := s.readKey(domain, ver)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// readKey reads a private key as PEM, decrypting it if needed. Caller should hold mu.
+func (s *Files) readKey(domain string, ver version) ([]byte, error) {
+	keyData, err := os.ReadFile(s.pathFor(domain, ver, privateKeyFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := s.keys.open(keyData, keyLocation(domain))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s key for %s: %w", ver, domain, err)
+	}
+
+	return keyPEM, nil
+}
+
+// EncryptExisting encrypts the private keys and ACME accounts that were written before encryption was enabled.
+// Returns how many files were encrypted. Files that are already encrypted are left as they are.
+func (s *Files) EncryptExisting() (int, error) {
+	if !s.keys.enabled() {
+		return 0, errors.New("no key-encryption key is configured")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encrypted := 0
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || (entry.Name() != privateKeyFilename && entry.Name() != acmeAccountFilename) {
+			return nil
+		}
+
+		plaintext, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if sealedBlock(plaintext) != nil {
+			return nil
+		}
+
+		location, err := s.locationOf(path)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := s.keys.seal(plaintext, location)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(path, sealed)
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", path, err)
+		}
+
+		encrypted++
+
+		return nil
+	})
+
+	return encrypted, err
+}
+
+// locationOf returns the location to encrypt the private key or ACME account at path with,
+// from the domain or directory URL it's stored under.
+func (s *Files) locationOf(path string) (string, error) {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return "", err
+	}
+
+	name, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if filepath.Base(path) == privateKeyFilename {
+		return keyLocation(name), nil
+	}
+
+	directory, err := url.PathUnescape(name)
+	if err != nil {
+		return "", fmt.Errorf("reading ACME directory of %s: %w", path, err)
+	}
+
+	return accountLocation(directory), nil
+}
+
+// writeFileAtomic writes a private file by writing a temporary file and renaming it into place,
+// so a crash can't leave it truncated.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+
+	err := os.WriteFile(tmpPath, data, keyPerms)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// removeAlternates removes the alternate chains of a version. Caller should hold mu.
+func (s *Files) removeAlternates(domain string, ver version) error {
+	paths, err := filepath.Glob(s.pathFor(domain, ver, alternatePattern))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Files) pathFor(domain string, ver version, file string) string {
+	return filepath.Join(s.dir, domain, string(ver), file)
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+func TestFiles(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, func(t *testing.T) func() Storage {
+		t.Helper()
+
+		storage, err := NewFiles(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The files backend can't be shared between processes, so handles share the instance and its lock
+		return func() Storage { return storage }
+	})
+}
+
+// testKEK returns a new key-encryption key.
+func testKEK() []byte {
+	kek := make([]byte, aesKeySize)
+	_, _ = rand.Read(kek)
+
+	return kek
+}
+
+// checkNoPlaintextKeys fails the test if any file in dir has an unencrypted private key.
+func checkNoPlaintextKeys(t *testing.T, dir string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Contains(data, []byte("PRIVATE KEY")) || bytes.Contains(data, []byte("PrivateKey")) {
+			t.Errorf("%s has an unencrypted private key", path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilesEncrypted(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, func(t *testing.T) func() Storage {
+		t.Helper()
+
+		dir := t.TempDir()
+		t.Cleanup(func() { checkNoPlaintextKeys(t, dir) })
+
+		storage, err := NewFiles(dir, testKEK())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return func() Storage { return storage }
+	})
+}
+
+// TestFilesEncryptExisting checks a data directory written without encryption can be read once it's
+// enabled, and then encrypted.
+func TestFilesEncryptExisting(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	plain, err := NewFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const domain = "migrating.salad"
+
+	key, err := plain.StoreNextKey(domain, config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = plain.StoreNextCert(domain, testCert(t, domain, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = plain.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acctKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const directory = "https://acme.salad/directory"
+	err = plain.StoreACME(directory, Account{URI: "https://acme.salad/acct/1", Key: acctKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := NewFiles(dir, testKEK())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before and after encrypting, everything can be read
+	for _, wantEncrypted := range []int{2, 0} {
+		_, err = encrypted.ReadCurrent(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = encrypted.ReadACME(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := encrypted.EncryptExisting()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != wantEncrypted {
+			t.Fatalf("Expected %d files to be encrypted, got %d", wantEncrypted, count)
+		}
+	}
+
+	checkNoPlaintextKeys(t, dir)
+
+	_, err = plain.ReadCurrent(domain)
+	if err == nil {
+		t.Fatal("Expected an error reading an encrypted key without the key-encryption key")
+	}
+
+	_, err = plain.EncryptExisting()
+	if err == nil {
+		t.Fatal("Expected an error encrypting without a key-encryption key")
+	}
+}
+
+// TestFilesKeyPerms checks private keys aren't readable by other users.
+func TestFilesKeyPerms(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	storage, err := NewFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.StoreNextKey("private.salad", config.KeyTypeP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "private.salad", "next", privateKeyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != keyPerms {
+		t.Fatalf("Expected key permissions %o, got %o", keyPerms, info.Mode().Perm())
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	storage, err := New(&config.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := storage.(*Files)
+	if !ok {
+		t.Fatalf("Expected files storage by default, got %T", storage)
+	}
+
+	_, err = New(&config.Config{Storage: config.Storage{Backend: "floppy"}})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown backend")
+	}
+
+	kekFile := filepath.Join(t.TempDir(), "kek.b64")
+	err = os.WriteFile(kekFile, []byte(base64.StdEncoding.EncodeToString(testKEK())), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(&config.Config{Storage: config.Storage{Backend: config.StorageVault, EncryptionKeyFile: kekFile}})
+	if err == nil || !strings.Contains(err.Error(), "isn't supported") {
+		t.Fatalf("Expected an error encrypting with the vault backend, got %v", err)
+	}
+}
@@ -0,0 +1,682 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+const (
+	// kubernetesTimeout for each request to the API server.
+	kubernetesTimeout = 30 * time.Second
+
+	// serviceAccountDir is where a pod's service account credentials are mounted.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+	// Secret types. TLS Secrets have the certificate chain and key in tlsCertKey and tlsKeyKey.
+	secretTypeTLS    = "kubernetes.io/tls"
+	secretTypeOpaque = "Opaque"
+
+	tlsCertKey = "tls.crt"
+	tlsKeyKey  = "tls.key"
+
+	// accountKey is the data key of the account JSON in an account Secret.
+	accountKey = "account.json"
+
+	// alternatePrefix starts the data keys of alternate chains, followed by their index.
+	alternatePrefix = "alternate-"
+
+	// Labels and annotations set on Secrets, to make them easy to find.
+	managedByLabel       = "app.kubernetes.io/managed-by"
+	managedBy            = "test-certs-site"
+	domainAnnotation     = "test-certs-site.letsencrypt.org/domain"
+	versionAnnotation    = "test-certs-site.letsencrypt.org/version"
+	directoryAnnotation  = "test-certs-site.letsencrypt.org/directory"
+	revocationAnnotation = "test-certs-site.letsencrypt.org/pending-revocation"
+	rejectionsAnnotation = "test-certs-site.letsencrypt.org/rejections"
+
+	// defaultKubernetesPrefix starts the names of Secrets, unless another prefix is configured.
+	defaultKubernetesPrefix = "test-certs-site"
+)
+
+// secretNameRE matches valid Secret names, which are DNS subdomains.
+var secretNameRE = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// errUnchanged is returned by a modify function to skip writing the Secret back.
+var errUnchanged = errors.New("secret unchanged")
+
+// Kubernetes keeps keys, certificates and accounts in Kubernetes Secrets.
+// Each domain's current and next key and certificate are kubernetes.io/tls Secrets,
+// so other workloads can mount them. ACME accounts are Opaque Secrets.
+// Updates are conditional on the Secret's resourceVersion, so instances sharing the Secrets don't lose writes.
+type Kubernetes struct {
+	http      *http.Client
+	apiServer string
+	namespace string
+	prefix    string
+	tokenFile string
+}
+
+// k8sSecret is a core/v1 Secret. Data values are base64 encoded in JSON, as a []byte is.
+type k8sSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   k8sMetadata       `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// k8sMetadata is the part of a Secret's ObjectMeta used here.
+type k8sMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// k8sStatus is the Status returned by the API server for errors.
+type k8sStatus struct {
+	Message string `json:"message"`
+}
+
+// NewKubernetes returns storage in Kubernetes Secrets.
+// Settings that aren't configured default to the pod's service account.
+func NewKubernetes(cfg config.Kubernetes) (*Kubernetes, error) {
+	apiServer := cfg.APIServer
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("no kubernetes API server: set apiServer, or run in a cluster")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespaceBytes, err := os.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("reading kubernetes namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(namespaceBytes))
+	}
+
+	tokenFile := cfg.TokenFile
+	if tokenFile == "" {
+		tokenFile = serviceAccountDir + "token"
+	}
+
+	caCertFile := cfg.CACertFile
+	if caCertFile == "" && cfg.APIServer == "" {
+		caCertFile = serviceAccountDir + "ca.crt"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // Always a Transport
+	if caCertFile != "" {
+		pemBytes, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading kubernetes CA certificates: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates in %s", caCertFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultKubernetesPrefix
+	}
+
+	return &Kubernetes{
+		http: &http.Client{
+			Timeout:   kubernetesTimeout,
+			Transport: transport,
+		},
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		namespace: namespace,
+		prefix:    prefix,
+		tokenFile: tokenFile,
+	}, nil
+}
+
+// ReadACME returns the stored ACME account for a given ACME server, identified by its directory URL.
+func (k *Kubernetes) ReadACME(directory string) (Account, error) {
+	if directory == "" {
+		return Account{}, errors.New("no ACME directory specified")
+	}
+
+	secret, err := k.get(k.accountName(directory))
+	if err != nil {
+		return Account{}, fmt.Errorf("reading ACME account for %s: %w", directory, err)
+	}
+
+	return unmarshalAccount(secret.Data[accountKey])
+}
+
+// StoreACME persists an account, for later retrieval with ReadACME.
+func (k *Kubernetes) StoreACME(directory string, acct Account) error {
+	accountJSON, err := marshalAccount(acct)
+	if err != nil {
+		return err
+	}
+
+	err = k.update(k.accountName(directory), func(secret *k8sSecret) error {
+		if secret.Metadata.ResourceVersion == "" {
+			secret.Type = secretTypeOpaque
+			secret.Metadata.Annotations[directoryAnnotation] = directory
+		}
+		secret.Data[accountKey] = accountJSON
+
+		return nil
+	})
+
+	return err
+}
+
+// StorePendingRevocation marks the next certificate as needing revocation.
+func (k *Kubernetes) StorePendingRevocation(domain string, pending PendingRevocation) error {
+	pendingJSON, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+
+	return k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		secret.Metadata.Annotations[revocationAnnotation] = string(pendingJSON)
+
+		return nil
+	})
+}
+
+// ReadPendingRevocation returns the revocation state of the next certificate.
+// Returns an error wrapping os.ErrNotExist if the certificate doesn't need revoking.
+func (k *Kubernetes) ReadPendingRevocation(domain string) (PendingRevocation, error) {
+	name, err := k.domainName(domain, next)
+	if err != nil {
+		return PendingRevocation{}, err
+	}
+
+	secret, err := k.get(name)
+	if err != nil {
+		return PendingRevocation{}, err
+	}
+
+	pendingJSON, ok := secret.Metadata.Annotations[revocationAnnotation]
+	if !ok {
+		return PendingRevocation{}, fmt.Errorf("no pending revocation for %s: %w", domain, os.ErrNotExist)
+	}
+
+	var pending PendingRevocation
+	err = json.Unmarshal([]byte(pendingJSON), &pending)
+	if err != nil {
+		return PendingRevocation{}, fmt.Errorf("parsing pending revocation for %s: %w", domain, err)
+	}
+
+	return pending, nil
+}
+
+// ClearPendingRevocation marks the next certificate as revoked.
+func (k *Kubernetes) ClearPendingRevocation(domain string) error {
+	err := k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		if _, ok := secret.Metadata.Annotations[revocationAnnotation]; !ok {
+			return errUnchanged
+		}
+		delete(secret.Metadata.Annotations, revocationAnnotation)
+
+		return nil
+	})
+
+	return err
+}
+
+// StoreRejections records the next certificates rejected in a row.
+func (k *Kubernetes) StoreRejections(domain string, rejections Rejections) error {
+	rejectionsJSON, err := json.Marshal(rejections)
+	if err != nil {
+		return err
+	}
+
+	return k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		secret.Metadata.Annotations[rejectionsAnnotation] = string(rejectionsJSON)
+
+		return nil
+	})
+}
+
+// ReadRejections returns the next certificates rejected in a row.
+// Returns an error wrapping os.ErrNotExist if none were.
+func (k *Kubernetes) ReadRejections(domain string) (Rejections, error) {
+	name, err := k.domainName(domain, next)
+	if err != nil {
+		return Rejections{}, err
+	}
+
+	secret, err := k.get(name)
+	if err != nil {
+		return Rejections{}, err
+	}
+
+	rejectionsJSON, ok := secret.Metadata.Annotations[rejectionsAnnotation]
+	if !ok {
+		return Rejections{}, fmt.Errorf("no rejections for %s: %w", domain, os.ErrNotExist)
+	}
+
+	var rejections Rejections
+	err = json.Unmarshal([]byte(rejectionsJSON), &rejections)
+	if err != nil {
+		return Rejections{}, fmt.Errorf("parsing rejections for %s: %w", domain, err)
+	}
+
+	return rejections, nil
+}
+
+// ClearRejections records that a next certificate was used.
+func (k *Kubernetes) ClearRejections(domain string) error {
+	err := k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		if _, ok := secret.Metadata.Annotations[rejectionsAnnotation]; !ok {
+			return errUnchanged
+		}
+		delete(secret.Metadata.Annotations, rejectionsAnnotation)
+
+		return nil
+	})
+
+	return err
+}
+
+// StoreNextKey generates a new next key. The next certificate is cleared.
+// Returns ErrPendingRevocation if it hasn't been revoked yet.
+func (k *Kubernetes) StoreNextKey(domain string, keyType string) (crypto.Signer, error) {
+	key, pemBytes, err := newKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	err = k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		if _, ok := secret.Metadata.Annotations[revocationAnnotation]; ok {
+			return fmt.Errorf("storing next key for %s: %w", domain, ErrPendingRevocation)
+		}
+
+		clear(secret.Data)
+		secret.Data[tlsKeyKey] = pemBytes
+		secret.Data[tlsCertKey] = []byte{}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// StoreNextCert stores the next certificate for the domain, as a PEM sequence.
+func (k *Kubernetes) StoreNextCert(domain string, certificates []byte) error {
+	return k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		secret.Data[tlsCertKey] = certificates
+
+		return nil
+	})
+}
+
+// StoreNextAlternates stores the next certificate's alternate chains, replacing any stored before.
+func (k *Kubernetes) StoreNextAlternates(domain string, chains [][]byte) error {
+	return k.updateDomain(domain, next, func(secret *k8sSecret) error {
+		for dataKey := range secret.Data {
+			if strings.HasPrefix(dataKey, alternatePrefix) {
+				delete(secret.Data, dataKey)
+			}
+		}
+
+		for idx, chain := range chains {
+			secret.Data[alternateKey(idx)] = chain
+		}
+
+		return nil
+	})
+}
+
+// TakeNext makes the next key, certificate and alternate chains current, in one write of the current Secret,
+// conditional on the resourceVersion it was read at. If another instance changes it first, it's read again,
+// and if the other instance took the same certificate, that's returned.
+// The next Secret isn't changed, so a take can't be left half done: a next certificate that's also current
+// has been taken, and isn't returned by ReadNext. It stays until a new next key replaces it.
+func (k *Kubernetes) TakeNext(domain string) (tls.Certificate, error) {
+	nextName, err := k.domainName(domain, next)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var cert tls.Certificate
+	err = k.updateDomain(domain, current, func(secret *k8sSecret) error {
+		nextSecret, err := k.get(nextName)
+		if err != nil {
+			return fmt.Errorf("reading next certificate: %w", err)
+		}
+
+		cert, err = parseKeyPair(nextSecret.Data[tlsCertKey], nextSecret.Data[tlsKeyKey])
+		if err != nil {
+			return fmt.Errorf("reading next certificate: %w", err)
+		}
+
+		if bytes.Equal(secret.Data[tlsCertKey], nextSecret.Data[tlsCertKey]) {
+			// Another instance took it first
+			return errUnchanged
+		}
+
+		clear(secret.Data)
+		for dataKey, value := range nextSecret.Data {
+			if dataKey == tlsCertKey || dataKey == tlsKeyKey || strings.HasPrefix(dataKey, alternatePrefix) {
+				secret.Data[dataKey] = value
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return cert, nil
+}
+
+// RemoveCurrent empties the current Secret. A TLS Secret must have a certificate and key, so they're left empty.
+func (k *Kubernetes) RemoveCurrent(domain string) error {
+	return k.updateDomain(domain, current, func(secret *k8sSecret) error {
+		clear(secret.Data)
+		secret.Data[tlsKeyKey] = []byte{}
+		secret.Data[tlsCertKey] = []byte{}
+
+		return nil
+	})
+}
+
+// ReadCurrent reads the current cert and key for this domain.
+func (k *Kubernetes) ReadCurrent(domain string) (tls.Certificate, error) {
+	return k.readKeyPair(domain, current)
+}
+
+// ReadCurrentAlternates reads the current key with each of the current certificate's alternate chains.
+func (k *Kubernetes) ReadCurrentAlternates(domain string) ([]tls.Certificate, error) {
+	name, err := k.domainName(domain, current)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := k.get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return []tls.Certificate{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	alternates := []tls.Certificate{}
+	for idx := 0; ; idx++ {
+		chain, ok := secret.Data[alternateKey(idx)]
+		if !ok {
+			break
+		}
+
+		cert, err := parseKeyPair(chain, secret.Data[tlsKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("reading alternate chain %d: %w", idx, err)
+		}
+		alternates = append(alternates, cert)
+	}
+
+	return alternates, nil
+}
+
+// ReadNext reads the next cert and key for this domain.
+// Returns an error wrapping os.ErrNotExist if the next certificate was taken, and so is also current.
+func (k *Kubernetes) ReadNext(domain string) (tls.Certificate, error) {
+	nextCert, err := k.readKeyPair(domain, next)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	currentCert, err := k.readKeyPair(domain, current)
+	if errors.Is(err, os.ErrNotExist) {
+		return nextCert, nil
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if bytes.Equal(currentCert.Certificate[0], nextCert.Certificate[0]) {
+		return tls.Certificate{}, fmt.Errorf("next certificate for %s was taken: %w", domain, os.ErrNotExist)
+	}
+
+	return nextCert, nil
+}
+
+// readKeyPair reads the certificate and key from the domain's Secret for ver.
+func (k *Kubernetes) readKeyPair(domain string, ver version) (tls.Certificate, error) {
+	name, err := k.domainName(domain, ver)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	secret, err := k.get(name)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return parseKeyPair(secret.Data[tlsCertKey], secret.Data[tlsKeyKey])
+}
+
+// alternateKey is the data key of the alternate chain at idx.
+func alternateKey(idx int) string {
+	return alternatePrefix + strconv.Itoa(idx) + ".crt"
+}
+
+// updateDomain updates the domain's TLS Secret for ver, creating it if needed.
+func (k *Kubernetes) updateDomain(domain string, ver version, modify func(*k8sSecret) error) error {
+	name, err := k.domainName(domain, ver)
+	if err != nil {
+		return err
+	}
+
+	return k.update(name, func(secret *k8sSecret) error {
+		if secret.Metadata.ResourceVersion == "" {
+			*secret = *k.newSecret(name, domain, ver)
+		}
+
+		return modify(secret)
+	})
+}
+
+// newSecret returns a TLS Secret for the domain, which hasn't been created yet.
+// A TLS Secret must always have a certificate and key, so they start empty.
+func (k *Kubernetes) newSecret(name, domain string, ver version) *k8sSecret {
+	return &k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sMetadata{
+			Name:        name,
+			Namespace:   k.namespace,
+			Labels:      map[string]string{managedByLabel: managedBy},
+			Annotations: map[string]string{domainAnnotation: domain, versionAnnotation: string(ver)},
+		},
+		Type: secretTypeTLS,
+		Data: map[string][]byte{tlsCertKey: {}, tlsKeyKey: {}},
+	}
+}
+
+// update reads the Secret name, changes it with modify, and writes it back conditional on its resourceVersion.
+// A Secret that doesn't exist is passed to modify without a resourceVersion, and is created.
+// If another writer changed the Secret in between, it's read and modified again.
+// If modify returns errUnchanged, nothing is written.
+func (k *Kubernetes) update(name string, modify func(*k8sSecret) error) error {
+	for range updateAttempts {
+		secret, err := k.get(name)
+		if errors.Is(err, os.ErrNotExist) {
+			secret = &k8sSecret{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Metadata: k8sMetadata{
+					Name:      name,
+					Namespace: k.namespace,
+					Labels:    map[string]string{managedByLabel: managedBy},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		if secret.Metadata.Annotations == nil {
+			secret.Metadata.Annotations = make(map[string]string)
+		}
+
+		err = modify(secret)
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = k.put(secret)
+		if !errors.Is(err, errVersionConflict) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("updating %s: %w", name, errVersionConflict)
+}
+
+// get reads the Secret name. Returns an error wrapping os.ErrNotExist if it doesn't exist.
+func (k *Kubernetes) get(name string) (*k8sSecret, error) {
+	var secret k8sSecret
+	status, err := k.do(http.MethodGet, name, nil, &secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("no secret %s: %w", name, os.ErrNotExist)
+	}
+
+	return &secret, nil
+}
+
+// put creates secret if it has no resourceVersion, or replaces it if its resourceVersion is still current.
+// Returns errVersionConflict if another writer created or changed it first.
+func (k *Kubernetes) put(secret *k8sSecret) error {
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	if secret.Metadata.ResourceVersion == "" {
+		_, err = k.do(http.MethodPost, "", body, nil)
+	} else {
+		_, err = k.do(http.MethodPut, secret.Metadata.Name, body, nil)
+	}
+
+	return err
+}
+
+// do makes a request for the Secret name in the namespace, or to the namespace's Secrets if name is empty.
+// A successful response is parsed into result, if it isn't nil. Reading a Secret that doesn't exist
+// returns status 404 without an error. Writes that conflict with another writer return errVersionConflict.
+func (k *Kubernetes) do(method, name string, body []byte, result any) (int, error) {
+	endpoint := k.apiServer + "/api/v1/namespaces/" + url.PathEscape(k.namespace) + "/secrets"
+	if name != "" {
+		endpoint += "/" + url.PathEscape(name)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("creating kubernetes request: %w", err)
+	}
+
+	// Service account tokens are rotated, so it's read for each request
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return 0, fmt.Errorf("reading kubernetes token: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("kubernetes request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("reading kubernetes response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return resp.StatusCode, nil
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusNotFound && method == http.MethodPut:
+		// A Secret deleted since it was read has been changed too
+		return resp.StatusCode, errVersionConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		var status k8sStatus
+		_ = json.Unmarshal(respBody, &status)
+
+		return resp.StatusCode, fmt.Errorf("kubernetes %s %s: status %d: %s", method, endpoint, resp.StatusCode, status.Message)
+	}
+
+	if result != nil {
+		err = json.Unmarshal(respBody, result)
+		if err != nil {
+			return 0, fmt.Errorf("parsing kubernetes response: %w", err)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// domainName is the name of the TLS Secret for a domain's current or next key and certificate.
+// Certificate names are lowercased, and the "+" before an additional key type isn't allowed in names.
+func (k *Kubernetes) domainName(domain string, ver version) (string, error) {
+	name := k.prefix + "-" + string(ver) + "-" + strings.ToLower(strings.ReplaceAll(domain, "+", "--"))
+	if len(name) > 253 || !secretNameRE.MatchString(name) {
+		return "", fmt.Errorf("%s can't be stored as a kubernetes secret named %s", domain, name)
+	}
+
+	return name, nil
+}
+
+// accountName is the name of the Opaque Secret for an ACME account.
+// Directory URLs can't be used in names, so they're hashed. The URL is kept in an annotation.
+func (k *Kubernetes) accountName(directory string) string {
+	hash := sha256.Sum256([]byte(directory))
+
+	return k.prefix + "-account-" + hex.EncodeToString(hash[:16])
+}
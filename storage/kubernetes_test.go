@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// fakeKubernetes is an in-process stand-in for the API server's Secrets endpoints,
+// with writes conditional on resourceVersion.
+type fakeKubernetes struct {
+	// mu protects the fields below
+	mu sync.Mutex
+
+	token   string
+	secrets map[string]k8sSecret
+	version int
+
+	// beforeWrite, if set, is called before each write is applied
+	beforeWrite func()
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	token, beforeWrite := f.token, f.beforeWrite
+	f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		writeK8sStatus(w, http.StatusUnauthorized, "Unauthorized")
+
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/api/v1/namespaces/salad-bar/secrets")
+	if !ok {
+		writeK8sStatus(w, http.StatusNotFound, "not found")
+
+		return
+	}
+	name := strings.TrimPrefix(rest, "/")
+
+	if r.Method == http.MethodGet {
+		f.mu.Lock()
+		secret, ok := f.secrets[name]
+		f.mu.Unlock()
+
+		if !ok {
+			writeK8sStatus(w, http.StatusNotFound, "secrets "+name+" not found")
+
+			return
+		}
+
+		writeK8sJSON(w, http.StatusOK, secret)
+
+		return
+	}
+
+	var secret k8sSecret
+	err := json.NewDecoder(r.Body).Decode(&secret)
+	if err != nil {
+		writeK8sStatus(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if secret.Type == secretTypeTLS && (secret.Data[tlsCertKey] == nil || secret.Data[tlsKeyKey] == nil) {
+		writeK8sStatus(w, http.StatusUnprocessableEntity, "TLS secrets need tls.crt and tls.key")
+
+		return
+	}
+
+	if beforeWrite != nil {
+		beforeWrite()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	existing, exists := f.secrets[secret.Metadata.Name]
+
+	switch {
+	case r.Method == http.MethodPost && name == "":
+		if exists {
+			writeK8sStatus(w, http.StatusConflict, "secrets "+secret.Metadata.Name+" already exists")
+
+			return
+		}
+	case r.Method == http.MethodPut && name == secret.Metadata.Name:
+		if !exists {
+			writeK8sStatus(w, http.StatusNotFound, "secrets "+name+" not found")
+
+			return
+		}
+		if secret.Metadata.ResourceVersion != existing.Metadata.ResourceVersion {
+			writeK8sStatus(w, http.StatusConflict, "the object has been modified")
+
+			return
+		}
+		if secret.Type != existing.Type {
+			writeK8sStatus(w, http.StatusUnprocessableEntity, "field is immutable")
+
+			return
+		}
+	default:
+		writeK8sStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+
+		return
+	}
+
+	f.version++
+	secret.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.secrets[secret.Metadata.Name] = secret
+
+	writeK8sJSON(w, http.StatusOK, secret)
+}
+
+func writeK8sJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeK8sStatus(w http.ResponseWriter, status int, message string) {
+	writeK8sJSON(w, status, map[string]any{"kind": "Status", "message": message})
+}
+
+// newTestKubernetes starts a fake API server, returning it with storage using it.
+func newTestKubernetes(t *testing.T) (*fakeKubernetes, *Kubernetes) {
+	t.Helper()
+
+	fake := &fakeKubernetes{token: "crouton", secrets: make(map[string]k8sSecret)}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("crouton\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewKubernetes(config.Kubernetes{
+		Namespace: "salad-bar",
+		APIServer: server.URL,
+		TokenFile: tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, storage
+}
+
+func TestKubernetes(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, func(t *testing.T) func() Storage {
+		t.Helper()
+
+		_, storage := newTestKubernetes(t)
+
+		return func() Storage {
+			handle := *storage
+
+			return &handle
+		}
+	})
+}
+
+// TestKubernetesTLSSecret checks the current certificate is a TLS Secret that other workloads can mount.
+func TestKubernetesTLSSecret(t *testing.T) {
+	t.Parallel()
+
+	fake, storage := newTestKubernetes(t)
+
+	const domain = "valid.example.com+rsa2048"
+
+	key, err := storage.StoreNextKey(domain, config.KeyTypeRSA2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.StoreNextCert(domain, testCert(t, "valid.example.com", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.TakeNext(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	secret, ok := fake.secrets["test-certs-site-current-valid.example.com--rsa2048"]
+	fake.mu.Unlock()
+
+	if !ok {
+		t.Fatal("Expected a current Secret")
+	}
+
+	if secret.Type != secretTypeTLS || secret.Metadata.Annotations[domainAnnotation] != domain {
+		t.Fatalf("Expected a TLS Secret for %s, got %s with annotations %v", domain, secret.Type, secret.Metadata.Annotations)
+	}
+
+	_, err = tls.X509KeyPair(secret.Data[tlsCertKey], secret.Data[tlsKeyKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKubernetesConflict checks TakeNext doesn't lose a write by another instance to the next Secret,
+// and retries when another instance changes the current Secret first.
+func TestKubernetesConflict(t *testing.T) {
+	t.Parallel()
+
+	fake, storage := newTestKubernetes(t)
+
+	const domain = "contested.salad"
+
+	for range 2 {
+		key, err := storage.StoreNextKey(domain, config.KeyTypeP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.StoreNextCert(domain, testCert(t, domain, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Another instance marks the certificate for revocation and takes it, while this one takes it
+		var done atomic.Bool
+		fake.mu.Lock()
+		fake.beforeWrite = func() {
+			if done.CompareAndSwap(false, true) {
+				err := storage.StorePendingRevocation(domain, PendingRevocation{Attempts: 3})
+				if err != nil {
+					t.Error(err)
+				}
+
+				_, err = storage.TakeNext(domain)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		fake.mu.Unlock()
+
+		taken, err := storage.TakeNext(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fake.mu.Lock()
+		fake.beforeWrite = nil
+		fake.mu.Unlock()
+
+		current, err := storage.ReadCurrent(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !current.Leaf.Equal(taken.Leaf) {
+			t.Fatal("Current certificate isn't the one taken")
+		}
+
+		_, err = storage.ReadNext(domain)
+		if err == nil {
+			t.Fatal("Expected the next certificate to have been taken")
+		}
+
+		pending, err := storage.ReadPendingRevocation(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending.Attempts != 3 {
+			t.Fatalf("Expected the concurrent write to be kept, got %+v", pending)
+		}
+
+		// The next key can't be replaced until the certificate is revoked
+		err = storage.ClearPendingRevocation(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKubernetesToken(t *testing.T) {
+	t.Parallel()
+
+	fake, storage := newTestKubernetes(t)
+	fake.mu.Lock()
+	fake.token = "wrong"
+	fake.mu.Unlock()
+
+	_, err := storage.ReadCurrent("forbidden.salad")
+	if err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("Expected an authentication error, got %v", err)
+	}
+}
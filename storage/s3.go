@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+const (
+	// s3Timeout for each request to the object storage service.
+	s3Timeout = 30 * time.Second
+
+	// s3DefaultRegion is used to sign requests when no region is configured.
+	s3DefaultRegion = "us-east-1"
+)
+
+// S3 keeps keys, certificates and accounts in an S3-compatible object storage bucket.
+// Each domain's next and current values are kept in one object, replaced with conditional writes,
+// so TakeNext is atomic even with several instances sharing the bucket.
+// Private keys can be encrypted before they're stored.
+type S3 struct {
+	documents
+
+	http      *http.Client
+	bucketURL string
+	prefix    string
+	region    string
+	creds     s3Credentials
+}
+
+// s3Credentials are the AWS credentials requests are signed with.
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// NewS3 returns storage in an S3 bucket. Credentials are read from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+// Private keys and ACME accounts are encrypted with kek, a 256-bit key-encryption key, unless it's nil.
+func NewS3(cfg config.S3, kek []byte) (*S3, error) {
+	creds := s3Credentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return nil, fmt.Errorf("no s3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	keys, err := newKeyCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return newS3(cfg, creds, keys), nil
+}
+
+// newS3 returns storage in an S3 bucket, with the given credentials and key encryption.
+func newS3(cfg config.S3, creds s3Credentials, keys keyCipher) *S3 {
+	region := cfg.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	// AWS uses virtual-hosted URLs, but other services generally only support the bucket in the path
+	bucketURL := "https://" + cfg.Bucket + ".s3." + region + ".amazonaws.com"
+	if cfg.Endpoint != "" {
+		bucketURL = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + s3Escape(cfg.Bucket)
+	}
+
+	s := &S3{
+		http:      &http.Client{Timeout: s3Timeout},
+		bucketURL: bucketURL,
+		prefix:    cfg.Prefix,
+		region:    region,
+		creds:     creds,
+	}
+	s.documents = documents{store: s, keys: keys}
+
+	return s
+}
+
+// s3Error is the XML body of an error response.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// get reads the object for the document called name into doc, returning its ETag.
+// An object that doesn't exist leaves doc unchanged, and returns an empty ETag.
+func (s *S3) get(name string, doc any) (string, error) {
+	key := name + ".json"
+
+	resp, body, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reading %s from s3: %w", key, s3ResponseError(resp, body))
+	}
+
+	err = json.Unmarshal(body, doc)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s from s3: %w", key, err)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// put writes doc to the object for the document called name, if its ETag is still etag,
+// or if it doesn't exist when etag is empty. Returns errVersionConflict if it has changed.
+func (s *S3) put(name string, doc any, etag string) error {
+	key := name + ".json"
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+
+	resp, respBody, err := s.do(http.MethodPut, key, header, body)
+	if err != nil {
+		return err
+	}
+
+	// Services return 409 when a concurrent conditional write is still in progress
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return errVersionConflict
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("writing %s to s3: %w", key, s3ResponseError(resp, respBody))
+	}
+
+	return nil
+}
+
+// s3ResponseError describes an unsuccessful response.
+func s3ResponseError(resp *http.Response, body []byte) error {
+	var parsed s3Error
+	_ = xml.Unmarshal(body, &parsed)
+
+	return fmt.Errorf("status %d: %s %s", resp.StatusCode, parsed.Code, parsed.Message)
+}
+
+// do makes a signed request for the object at key, returning the response and its body.
+func (s *S3) do(method, key string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), method, s.bucketURL+"/"+s3Escape(s.prefix+key), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating s3 request: %w", err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(payloadHash[:]), s.creds, s.region, time.Now())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3 request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading s3 response: %w", err)
+	}
+
+	return resp, respBody, nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req, signing all of its headers.
+// payloadHash is the hex SHA-256 of the request body.
+func signV4(req *http.Request, payloadHash string, creds s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes an object key as AWS Signature Version 4 requires: everything except
+// unreserved characters and slashes. Notably "+", which is in certificate names, is encoded.
+func s3Escape(key string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
@@ -1,9 +1,10 @@
-// Package storage handles keeping the files on disk.
+// Package storage handles keeping keys, certificates and ACME accounts.
 package storage
 
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -13,14 +14,111 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"net/url"
 	"os"
-	"path/filepath"
-	"sync"
+	"time"
 
 	"github.com/letsencrypt/test-certs-site/config"
 )
 
+// Storage is a backend for keeping each domain's current and next keys and certificates, and ACME accounts.
+// Values that were never stored are reported by an error wrapping os.ErrNotExist.
+type Storage interface {
+	// ReadACME returns the stored ACME account for a given ACME server, identified by its directory URL.
+	ReadACME(directory string) (Account, error)
+
+	// StoreACME persists an account, for later retrieval with ReadACME. It replaces any account stored before.
+	StoreACME(directory string, acct Account) error
+
+	// StorePendingRevocation marks the next certificate as needing revocation.
+	// It should be stored before the certificate is requested, so a crash can't leave an issued certificate
+	// without it.
+	StorePendingRevocation(domain string, pending PendingRevocation) error
+
+	// ReadPendingRevocation returns the revocation state of the next certificate.
+	ReadPendingRevocation(domain string) (PendingRevocation, error)
+
+	// ClearPendingRevocation marks the next certificate as revoked.
+	ClearPendingRevocation(domain string) error
+
+	// StoreRejections records the next certificates rejected in a row. Unlike a pending revocation,
+	// it's kept when the next key is replaced.
+	StoreRejections(domain string, rejections Rejections) error
+
+	// ReadRejections returns the next certificates rejected in a row.
+	ReadRejections(domain string) (Rejections, error)
+
+	// ClearRejections records that a next certificate was used.
+	ClearRejections(domain string) error
+
+	// StoreNextKey generates and stores a new next key of keyType.
+	// Any alternate chains are cleared, as the next certificate they were for is being replaced.
+	// Returns ErrPendingRevocation if the next certificate hasn't been revoked yet, as the record of it would be
+	// lost. It must be revoked, or given up on with ClearPendingRevocation, first.
+	StoreNextKey(domain string, keyType string) (crypto.Signer, error)
+
+	// StoreNextCert stores the next certificate, as a PEM sequence matching the next key.
+	StoreNextCert(domain string, certificates []byte) error
+
+	// StoreNextAlternates stores the next certificate's alternate chains, replacing any stored before.
+	// Each is a PEM sequence, starting with the same leaf as the certificate from StoreNextCert.
+	StoreNextAlternates(domain string, chains [][]byte) error
+
+	// TakeNext makes the next key, certificate and alternate chains current, and returns the new current
+	// certificate. Backends that can be shared between processes should make it atomic,
+	// so the current key and certificate always match.
+	TakeNext(domain string) (tls.Certificate, error)
+
+	// RemoveCurrent removes the current certificate, key and alternate chains, so a certificate that shouldn't
+	// be used isn't served again after a restart.
+	RemoveCurrent(domain string) error
+
+	// ReadCurrent reads the current certificate and key.
+	ReadCurrent(domain string) (tls.Certificate, error)
+
+	// ReadCurrentAlternates reads the current key with each of the current certificate's alternate chains.
+	// Returns an empty list if there are none.
+	ReadCurrentAlternates(domain string) ([]tls.Certificate, error)
+
+	// ReadNext reads the next certificate and key.
+	ReadNext(domain string) (tls.Certificate, error)
+}
+
+// New returns the storage backend selected in the configuration.
+// A key-encryption key is read from the configured file, or the TEST_CERTS_SITE_ENCRYPTION_KEY environment variable.
+func New(cfg *config.Config) (Storage, error) {
+	kek, err := loadKEK(cfg.Storage.EncryptionKeyFile, os.Getenv(encryptionKeyEnv))
+	if err != nil {
+		return nil, err
+	}
+
+	if kek != nil && (cfg.Storage.Backend == config.StorageVault || cfg.Storage.Backend == config.StorageKubernetes) {
+		return nil, fmt.Errorf("encrypting private keys isn't supported by the %q storage backend", cfg.Storage.Backend)
+	}
+
+	switch cfg.Storage.Backend {
+	case "", config.StorageFiles:
+		return NewFiles(cfg.DataDir, kek)
+	case config.StorageVault:
+		return NewVault(cfg.Storage.Vault)
+	case config.StorageKubernetes:
+		return NewKubernetes(cfg.Storage.Kubernetes)
+	case config.StorageS3:
+		return NewS3(cfg.Storage.S3, kek)
+	default:
+		// Should be unreachable due to config validation
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Storage.Backend)
+	}
+}
+
+// ErrPendingRevocation is returned by StoreNextKey while the next certificate has a pending revocation.
+var ErrPendingRevocation = errors.New("next certificate has a pending revocation")
+
+// errVersionConflict is returned when a conditional write finds the value was changed since it was read.
+var errVersionConflict = errors.New("secret was changed by another writer")
+
+// updateAttempts is how many times a conditional write is tried, when another writer changes the value first.
+const updateAttempts = 5
+
 type version string
 
 const (
@@ -28,33 +126,22 @@ const (
 	current version = "current"
 )
 
-const (
-	privateKeyFilename  = "private.pem"
-	certificateFilename = "certificate.pem"
-	acmeAccountFilename = "acme.json"
-)
-
-const (
-	// dirPerms rwxr-xr-x for created directories. Writable only by user, but global r & x for debugging.
-	dirPerms = 0o755
+// Account is an ACME account stored for an ACME server.
+type Account struct {
+	// URI of the account on the ACME server.
+	URI string
 
-	// keyPerms rw------- for private keys. No permissions outside of user.
-	keyPerms = 0o600
+	// Key is the account's private key.
+	Key *ecdsa.PrivateKey
 
-	// certPerms rw-r--r-- for cert files. Globally readable certs for debugging.
-	certPerms = 0o644
-)
+	// EABKeyID is the External Account Binding key ID the account was registered with, if any.
+	EABKeyID string
 
-// Storage of files for a domain.
-type Storage struct {
-	// mu prevents simultaneous writing of files, or reading while writing.
-	mu  sync.Mutex
-	dir string
-}
+	// KeyCreated is when Key was generated. Zero for accounts stored before this was recorded.
+	KeyCreated time.Time
 
-// New storage handle.
-func New(storageDir string) (*Storage, error) {
-	return &Storage{dir: storageDir}, nil
+	// PreviousKey is set while a key rollover is in progress, until the CA has confirmed the change to Key.
+	PreviousKey *ecdsa.PrivateKey
 }
 
 // account is the stored JSON for an ACME account.
@@ -64,87 +151,146 @@ type account struct {
 
 	// P256 Private Key
 	PrivateKey []byte
+
+	// External Account Binding key ID used at registration
+	EABKeyID string `json:",omitempty"`
+
+	// When PrivateKey was generated
+	KeyCreated time.Time `json:",omitzero"`
+
+	// P256 Private Key being replaced by PrivateKey, during a key rollover
+	PreviousPrivateKey []byte `json:",omitempty"`
 }
 
-// ReadACME returns the stored ACME account for a given ACME server, identified by its directory URL.
-// If an account was previously saved, the account URI and its private key are returned.
-func (s *Storage) ReadACME(directory string) (string, *ecdsa.PrivateKey, error) {
-	if directory == "" {
-		return "", nil, errors.New("no ACME directory specified")
+// marshalAccount encodes an account as the JSON kept by every backend.
+func marshalAccount(acct Account) ([]byte, error) {
+	keyBytes, err := x509.MarshalECPrivateKey(acct.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := account{
+		AccountURI: acct.URI,
+		PrivateKey: keyBytes,
+		EABKeyID:   acct.EABKeyID,
+		KeyCreated: acct.KeyCreated,
 	}
 
-	file, err := os.Open(s.pathFor(url.PathEscape(directory), current, acmeAccountFilename))
-	if err != nil {
-		return "", nil, err
+	if acct.PreviousKey != nil {
+		stored.PreviousPrivateKey, err = x509.MarshalECPrivateKey(acct.PreviousKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	defer file.Close()
+	return json.Marshal(stored)
+}
 
+// unmarshalAccount decodes an account encoded by marshalAccount.
+func unmarshalAccount(accountJSON []byte) (Account, error) {
 	var acct account
-	err = json.NewDecoder(file).Decode(&acct)
+	err := json.Unmarshal(accountJSON, &acct)
 	if err != nil {
-		return "", nil, fmt.Errorf("reading account json: %w", err)
+		return Account{}, fmt.Errorf("reading account json: %w", err)
 	}
 
 	key, err := x509.ParseECPrivateKey(acct.PrivateKey)
 	if err != nil {
-		return "", nil, fmt.Errorf("parsing account private key: %w", err)
+		return Account{}, fmt.Errorf("parsing account private key: %w", err)
 	}
 
-	return acct.AccountURI, key, nil
+	var previousKey *ecdsa.PrivateKey
+	if len(acct.PreviousPrivateKey) > 0 {
+		previousKey, err = x509.ParseECPrivateKey(acct.PreviousPrivateKey)
+		if err != nil {
+			return Account{}, fmt.Errorf("parsing previous account private key: %w", err)
+		}
+	}
+
+	return Account{
+		URI:         acct.AccountURI,
+		Key:         key,
+		EABKeyID:    acct.EABKeyID,
+		KeyCreated:  acct.KeyCreated,
+		PreviousKey: previousKey,
+	}, nil
 }
 
-// StoreACME persists an account to disk, for later retrieval with ReadACME.
-func (s *Storage) StoreACME(directory string, accountURI string, key *ecdsa.PrivateKey) error {
-	keyBytes, err := x509.MarshalECPrivateKey(key)
-	if err != nil {
-		return err
-	}
+// PendingRevocation records that the next certificate was requested, but hasn't been revoked yet.
+type PendingRevocation struct {
+	// KeySPKIHash identifies the next key the certificate is for, as the hex SHA-256 hash of its
+	// SubjectPublicKeyInfo. If the certificate was issued but never stored, it can be looked up by this.
+	KeySPKIHash string `json:",omitempty"`
 
-	acct := account{
-		AccountURI: accountURI,
-		PrivateKey: keyBytes,
-	}
+	// Attempts made to revoke the certificate so far.
+	Attempts int
 
-	err = os.MkdirAll(s.pathFor(url.PathEscape(directory), current, ""), dirPerms)
-	if err != nil {
-		return err
-	}
+	// RetryAt is when to make the next attempt. Zero to try right away.
+	RetryAt time.Time `json:",omitzero"`
+}
 
-	path := s.pathFor(url.PathEscape(directory), current, acmeAccountFilename)
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, keyPerms) //nolint:gosec // Arbitrary file is not a risk here
-	if err != nil {
-		return err
+// Rejections records next certificates that couldn't be used, so replacing them can back off, and stop.
+type Rejections struct {
+	// Count of next certificates rejected in a row.
+	Count int
+
+	// Serial number of the last certificate rejected, in hex.
+	Serial string
+
+	// RetryAt is when to replace the last certificate rejected.
+	RetryAt time.Time `json:",omitzero"`
+}
+
+// parseKeyPair parses a PEM certificate and key, either of which may not have been stored.
+func parseKeyPair(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificate and key stored: %w", os.ErrNotExist)
 	}
 
-	return json.NewEncoder(file).Encode(acct)
+	return tls.X509KeyPair(certPEM, keyPEM)
 }
 
-// StoreNextKey generates a new "next" key, writing it to disk.
-func (s *Storage) StoreNextKey(domain string, keyType string) (crypto.Signer, error) {
+// newKey generates a key of keyType, returning it along with its PKCS #8 PEM encoding.
+func newKey(keyType string) (crypto.Signer, []byte, error) {
 	var key crypto.Signer
 	switch keyType {
 	case config.KeyTypeP256:
 		p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		key = p256Key
-	case config.KeyTypeRSA2048:
-		bits := 2048
+	case config.KeyTypeP384:
+		p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = p384Key
+	case config.KeyTypeRSA2048, config.KeyTypeRSA3072, config.KeyTypeRSA4096:
+		bits := map[string]int{
+			config.KeyTypeRSA2048: 2048,
+			config.KeyTypeRSA3072: 3072,
+			config.KeyTypeRSA4096: 4096,
+		}[keyType]
 		rsaKey, err := rsa.GenerateKey(rand.Reader, bits)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		key = rsaKey
+	case config.KeyTypeEd25519:
+		_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = ed25519Key
 	default:
 		// Should be unreachable due to config validation
-		return nil, fmt.Errorf("unknown key type: %s", keyType)
+		return nil, nil, fmt.Errorf("unknown key type: %s", keyType)
 	}
 
 	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	pemBytes := pem.EncodeToMemory(&pem.Block{
@@ -152,91 +298,5 @@ func (s *Storage) StoreNextKey(domain string, keyType string) (crypto.Signer, er
 		Bytes: keyBytes,
 	})
 
-	path := s.pathFor(domain, next, privateKeyFilename)
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	err = os.MkdirAll(filepath.Dir(path), dirPerms)
-	if err != nil {
-		return nil, err
-	}
-
-	err = os.WriteFile(path, pemBytes, keyPerms)
-	if err != nil {
-		return nil, err
-	}
-
-	return key, nil
-}
-
-// StoreNextCert stores the next certificate for the domain.
-// Certificates should be a PEM sequence to write to disk.
-func (s *Storage) StoreNextCert(domain string, certificates []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	certPath := s.pathFor(domain, next, certificateFilename)
-	err := os.WriteFile(certPath, certificates, certPerms)
-	if err != nil {
-		return fmt.Errorf("could not write certificate: %w", err)
-	}
-
-	return nil
-}
-
-// TakeNext overwrites the current cert/key with the next cert/key, and returns the new current values.
-func (s *Storage) TakeNext(domain string) (tls.Certificate, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	err := os.MkdirAll(s.pathFor(domain, current, ""), dirPerms)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-
-	// Read the next values we're about to make current.
-	// Doing this before renaming ensures the key and certificate match.
-	cert, err := s.read(domain, next)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("reading next certificate: %w", err)
-	}
-
-	for _, path := range []string{privateKeyFilename, certificateFilename} {
-		nextPath := s.pathFor(domain, next, path)
-		currPath := s.pathFor(domain, current, path)
-		err := os.Rename(nextPath, currPath)
-		if err != nil {
-			return tls.Certificate{}, err
-		}
-	}
-
-	return cert, nil
-}
-
-// ReadCurrent reads the current cert and key for this domain.
-// Returns an error if the stored value couldn't be read or parsed.
-func (s *Storage) ReadCurrent(domain string) (tls.Certificate, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return s.read(domain, current)
-}
-
-// ReadNext reads the next cert and key for this domain.
-// Returns an error if the stored value couldn't be read or parsed.
-func (s *Storage) ReadNext(domain string) (tls.Certificate, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return s.read(domain, next)
-}
-
-// read a cert and key. Common logic for ReadCurrent and ReadNext. Caller should hold mu.
-func (s *Storage) read(domain string, ver version) (tls.Certificate, error) {
-	return tls.LoadX509KeyPair(s.pathFor(domain, ver, certificateFilename), s.pathFor(domain, ver, privateKeyFilename))
-}
-
-func (s *Storage) pathFor(domain string, ver version, file string) string {
-	return filepath.Join(s.dir, domain, string(ver), file)
+	return key, pemBytes, nil
 }
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// vaultTimeout for each request to Vault.
+const vaultTimeout = 30 * time.Second
+
+// Vault keeps keys, certificates and accounts in a HashiCorp Vault KV version 2 secrets engine.
+// Each domain's next and current values are kept in one secret, updated with check-and-set,
+// so TakeNext is atomic even with several instances sharing the secrets.
+type Vault struct {
+	documents
+
+	http      *http.Client
+	address   string
+	mount     string
+	path      string
+	namespace string
+
+	// tokenFile is read for each request, if it's set. Otherwise token is used.
+	tokenFile string
+	token     string
+}
+
+// NewVault returns storage in Vault. The token is read from cfg.TokenFile, or the VAULT_TOKEN environment variable.
+func NewVault(cfg config.Vault) (*Vault, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // Always a Transport
+	if cfg.CACertFile != "" {
+		pemBytes, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading vault CA certificates: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACertFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	mount := cfg.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+
+	v := &Vault{
+		http: &http.Client{
+			Timeout:   vaultTimeout,
+			Transport: transport,
+		},
+		address:   strings.TrimSuffix(cfg.Address, "/"),
+		mount:     strings.Trim(mount, "/"),
+		path:      strings.Trim(cfg.Path, "/"),
+		namespace: cfg.Namespace,
+		tokenFile: cfg.TokenFile,
+		token:     os.Getenv("VAULT_TOKEN"),
+	}
+	v.documents = documents{store: v}
+
+	token, err := v.readToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("no vault token: set a token file or VAULT_TOKEN")
+	}
+
+	return v, nil
+}
+
+// readToken returns the token from the token file, or from VAULT_TOKEN if there's no file.
+// Tokens are renewed by rewriting the file, as Vault Agent does, so it's read for each request.
+func (v *Vault) readToken() (string, error) {
+	if v.tokenFile == "" {
+		return v.token, nil
+	}
+
+	tokenBytes, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading vault token: %w", err)
+	}
+
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+// vaultResponse is a KV version 2 response, from reading or writing a secret.
+type vaultResponse struct {
+	Data struct {
+		// Data is the secret, only returned when reading
+		Data json.RawMessage `json:"data"`
+
+		// Metadata is returned when reading. Its fields are in Data when writing.
+		Metadata struct {
+			Version int `json:"version"`
+		} `json:"metadata"`
+	} `json:"data"`
+
+	Errors []string `json:"errors"`
+
+	// status is the HTTP status code
+	status int
+}
+
+// get reads the secret for the document called name into doc, returning its version.
+// A secret that doesn't exist, or whose latest version was deleted, leaves doc unchanged,
+// with the version to check-and-set against to replace it: 0 if it never existed.
+func (v *Vault) get(name string, doc any) (string, error) {
+	secretPath := path.Join(v.path, name)
+
+	resp, err := v.do(http.MethodGet, secretPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.status == http.StatusNotFound {
+		// A deleted version still has metadata, which is needed to write a new version
+		return strconv.Itoa(resp.Data.Metadata.Version), nil
+	}
+
+	if resp.status != http.StatusOK {
+		return "", fmt.Errorf("reading %s from vault: status %d: %s", secretPath, resp.status, strings.Join(resp.Errors, ", "))
+	}
+
+	if len(resp.Data.Data) > 0 && !bytes.Equal(resp.Data.Data, []byte("null")) {
+		err = json.Unmarshal(resp.Data.Data, doc)
+		if err != nil {
+			return "", fmt.Errorf("parsing %s from vault: %w", secretPath, err)
+		}
+	}
+
+	return strconv.Itoa(resp.Data.Metadata.Version), nil
+}
+
+// put writes doc to the secret for the document called name, if its current version is still version.
+// Returns errVersionConflict if it isn't.
+func (v *Vault) put(name string, doc any, version string) error {
+	secretPath := path.Join(v.path, name)
+
+	cas, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Errorf("invalid vault secret version %q: %w", version, err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"options": map[string]int{"cas": cas},
+		"data":    doc,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.do(http.MethodPost, secretPath, body)
+	if err != nil {
+		return err
+	}
+
+	if resp.status == http.StatusBadRequest && strings.Contains(strings.Join(resp.Errors, ", "), "check-and-set") {
+		return errVersionConflict
+	}
+
+	if resp.status != http.StatusOK && resp.status != http.StatusNoContent {
+		return fmt.Errorf("writing %s to vault: status %d: %s", secretPath, resp.status, strings.Join(resp.Errors, ", "))
+	}
+
+	return nil
+}
+
+// do makes a request to the KV data endpoint for secretPath, returning the parsed response.
+func (v *Vault) do(method, secretPath string, body []byte) (*vaultResponse, error) {
+	endpoint := v.address + "/v1/" + path.Join(v.mount, "data", secretPath)
+
+	req, err := http.NewRequestWithContext(context.Background(), method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating vault request: %w", err)
+	}
+
+	token, err := v.readToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading vault response: %w", err)
+	}
+
+	parsed := vaultResponse{status: resp.StatusCode}
+	if len(respBody) > 0 {
+		// Error responses from proxies in front of Vault might not be JSON, so only the status is relied on
+		_ = json.Unmarshal(respBody, &parsed)
+	}
+
+	return &parsed, nil
+}
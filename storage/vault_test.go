@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/letsencrypt/test-certs-site/config"
+)
+
+// fakeVault is an in-process stand-in for the KV version 2 HTTP API, with check-and-set writes.
+type fakeVault struct {
+	// mu protects the fields below
+	mu sync.Mutex
+
+	secrets map[string][]json.RawMessage
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "crouton" {
+		writeVaultJSON(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+
+		return
+	}
+
+	secretPath, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+	if !ok {
+		writeVaultJSON(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		f.mu.Lock()
+		versions := f.secrets[secretPath]
+		f.mu.Unlock()
+
+		if len(versions) == 0 {
+			writeVaultJSON(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+
+			return
+		}
+
+		writeVaultJSON(w, http.StatusOK, map[string]any{"data": map[string]any{
+			"data":     versions[len(versions)-1],
+			"metadata": map[string]int{"version": len(versions)},
+		}})
+	case http.MethodPost:
+		var body struct {
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+			Data json.RawMessage `json:"data"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeVaultJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{err.Error()}})
+
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		versions := f.secrets[secretPath]
+		if body.Options.CAS != nil && *body.Options.CAS != len(versions) {
+			writeVaultJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{
+				"check-and-set parameter did not match the current version",
+			}})
+
+			return
+		}
+
+		f.secrets[secretPath] = append(versions, body.Data)
+
+		writeVaultJSON(w, http.StatusOK, map[string]any{"data": map[string]int{"version": len(versions) + 1}})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeVaultJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// newTestVault starts a fake Vault server, returning a function opening storage using it.
+func newTestVault(t *testing.T) func() Storage {
+	t.Helper()
+
+	server := httptest.NewServer(&fakeVault{secrets: make(map[string][]json.RawMessage)})
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "vault.token")
+	err := os.WriteFile(tokenFile, []byte("crouton\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() Storage {
+		storage, err := NewVault(config.Vault{
+			Address:   server.URL,
+			Path:      "test-certs-site",
+			TokenFile: tokenFile,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return storage
+	}
+}
+
+func TestVault(t *testing.T) {
+	t.Parallel()
+
+	testConformance(t, newTestVault)
+}
+
+// TestVaultToken checks a renewed token is used without restarting.
+func TestVaultToken(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(&fakeVault{secrets: make(map[string][]json.RawMessage)})
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "vault.token")
+	err := os.WriteFile(tokenFile, []byte("stale"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewVault(config.Vault{Address: server.URL, TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadCurrent("renewed.salad")
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Fatalf("Expected a 403 with the stale token, got %v", err)
+	}
+
+	err = os.WriteFile(tokenFile, []byte("crouton\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.ReadCurrent("renewed.salad")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist with the renewed token, got %v", err)
+	}
+}